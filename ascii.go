@@ -0,0 +1,129 @@
+package ftpd
+
+import (
+	"io"
+	"io/ioutil"
+
+	"github.com/Edgaru089/ftpd/mount"
+)
+
+// This file houses the line ending conversion for ASCII mode (TYPE A) transfers.
+//
+// Files are stored with (Unix) LF line endings, and sent in the Telnet CRLF
+// convention. Existing CRLFs and stray CRs are kept as is.
+
+// crlfReader converts bare LFs read from r into CRLFs.
+type crlfReader struct {
+	r   io.Reader
+	buf []byte
+	i   int   // buf[i:] is not yet read
+	err error // error from r, returned after buf is drained
+
+	lastCR bool // the last byte read was a CR
+	lf     bool // a LF is pending after an inserted CR
+}
+
+func newCRLFReader(r io.Reader) *crlfReader {
+	return &crlfReader{r: r, buf: make([]byte, 0, 32*1024)}
+}
+
+func (a *crlfReader) Read(p []byte) (n int, err error) {
+	for n < len(p) {
+		if a.lf {
+			p[n] = '\n'
+			n++
+			a.lf = false
+			continue
+		}
+		if a.i == len(a.buf) {
+			if a.err != nil || n > 0 {
+				break
+			}
+			var k int
+			k, a.err = a.r.Read(a.buf[:cap(a.buf)])
+			a.buf, a.i = a.buf[:k], 0
+			continue
+		}
+
+		b := a.buf[a.i]
+		a.i++
+		if b == '\n' && !a.lastCR {
+			p[n] = '\r'
+			n++
+			a.lf = true
+			a.lastCR = false
+			continue
+		}
+		a.lastCR = b == '\r'
+		p[n] = b
+		n++
+	}
+
+	if n == 0 && len(p) != 0 {
+		return 0, a.err
+	}
+	return n, nil
+}
+
+// lfWriter converts CRLFs written into LFs before writing to w.
+//
+// A trailing CR is held back until the next Write, so Flush must be
+// called after the last Write.
+type lfWriter struct {
+	w   io.Writer
+	cr  bool // a CR is held back
+	buf []byte
+}
+
+func newLFWriter(w io.Writer) *lfWriter {
+	return &lfWriter{w: w}
+}
+
+func (a *lfWriter) Write(p []byte) (n int, err error) {
+	a.buf = a.buf[:0]
+	for _, b := range p {
+		if a.cr {
+			a.cr = false
+			if b != '\n' {
+				a.buf = append(a.buf, '\r')
+			}
+		}
+		if b == '\r' {
+			a.cr = true
+			continue
+		}
+		a.buf = append(a.buf, b)
+	}
+
+	if _, err = a.w.Write(a.buf); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Flush writes the held back CR, if any.
+func (a *lfWriter) Flush() error {
+	if a.cr {
+		a.cr = false
+		_, err := a.w.Write([]byte{'\r'})
+		return err
+	}
+	return nil
+}
+
+// Largest file asciiSize is asked to read through. SIZE is refused in
+// ASCII mode for larger ones, as the control connection waits meanwhile.
+const maxASCIISize = 1 << 20
+
+// asciiSize returns the size of the file as it would be transferred in
+// ASCII mode, by reading it through.
+func asciiSize(node mount.Node, file string) (int64, error) {
+	f, err := node.ReadFile(file)
+	if err != nil {
+		return 0, err
+	}
+	if closer, ok := f.(io.Closer); ok {
+		defer closer.Close()
+	}
+	return io.Copy(ioutil.Discard, newCRLFReader(f))
+}
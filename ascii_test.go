@@ -0,0 +1,60 @@
+package ftpd
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+var asciiTests = []struct{ lf, crlf string }{
+	{"", ""},
+	{"no newline", "no newline"},
+	{"unix\nlines\n", "unix\r\nlines\r\n"},
+	{"dos\r\nlines\r\n", "dos\r\nlines\r\n"},
+	{"mixed\nline\r\nendings\n\n", "mixed\r\nline\r\nendings\r\n\r\n"},
+	{"stray\rcr\r", "stray\rcr\r"},
+	{"\n\r\n\r\r\n", "\r\n\r\n\r\r\n"},
+}
+
+func TestCRLFReader(t *testing.T) {
+	for _, tc := range asciiTests {
+		// OneByteReader tests conversions across reads
+		for _, r := range []io.Reader{strings.NewReader(tc.lf), iotest.OneByteReader(strings.NewReader(tc.lf))} {
+			got, err := ioutil.ReadAll(newCRLFReader(r))
+			if err != nil {
+				t.Errorf("%q: read error: %s", tc.lf, err)
+			}
+			if string(got) != tc.crlf {
+				t.Errorf("%q: got %q, want %q", tc.lf, got, tc.crlf)
+			}
+		}
+	}
+}
+
+func TestLFWriter(t *testing.T) {
+	for _, tc := range asciiTests {
+		if strings.Contains(tc.lf, "\r\n") {
+			continue // Not the same after a round trip
+		}
+
+		// Write whole, and byte by byte
+		for _, step := range []int{len(tc.crlf) + 1, 1} {
+			var buf bytes.Buffer
+			w := newLFWriter(&buf)
+			for i := 0; i < len(tc.crlf); i += step {
+				end := i + step
+				if end > len(tc.crlf) {
+					end = len(tc.crlf)
+				}
+				w.Write([]byte(tc.crlf[i:end]))
+			}
+			w.Flush()
+			if buf.String() != tc.lf {
+				t.Errorf("%q (step %d): got %q, want %q", tc.crlf, step, buf.String(), tc.lf)
+			}
+		}
+	}
+}
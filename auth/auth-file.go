@@ -5,6 +5,8 @@ import (
 	"bytes"
 	"log"
 	"os"
+
+	"github.com/Edgaru089/ftpd/mount"
 )
 
 // File represents an authenticator from an text file.
@@ -12,19 +14,25 @@ import (
 // The file has lines that are either empty, begin with #,
 // or with the following format:
 //
-//    [Username]:[Password]:["r" or "rw"]
+//    [Username]:[Password]:["r" or "rw"][:Home folder]
 //
 // The first colon ends the username, and the last ends the password.
 // A line ending in "r" represents a read-only account, while one ending
 // in "rw" represents a read-write one.
 //
+// The optional home folder is an absolute path on the virtual filesystem,
+// like "/home/alice", which becomes the root of the user.
+//
 // Usernames are unique and later ones overwrite existing ones.
 type File struct {
 	// string key is username
-	m map[string]struct {
-		pass string
-		l    AccessType
-	}
+	m map[string]fileUser
+}
+
+type fileUser struct {
+	pass string
+	l    AccessType
+	home string
 }
 
 // Login implements Auth.Login.
@@ -36,6 +44,12 @@ func (a *File) Login(username, password string) AccessType {
 	return obj.l
 }
 
+// Root implements auth.Root, returning the home folder of the user.
+// Users with no home column are served the whole server filesystem.
+func (a *File) Root(username string) (node mount.Node, home string) {
+	return nil, a.m[username].home
+}
+
 // NewFile creates a new file based authenticator.
 func NewFile(filename string) (a *File, err error) {
 	var f *os.File
@@ -44,10 +58,7 @@ func NewFile(filename string) (a *File, err error) {
 		return
 	}
 
-	a = &File{m: make(map[string]struct {
-		pass string
-		l    AccessType
-	})}
+	a = &File{m: make(map[string]fileUser)}
 
 	lnum := 0
 	sc := bufio.NewScanner(f)
@@ -59,6 +70,13 @@ func NewFile(filename string) (a *File, err error) {
 			continue
 		}
 
+		// A home folder begins with a slash, which a mode does not
+		var home string
+		if id := bytes.LastIndexByte(line, ':'); id != -1 && id+1 < len(line) && line[id+1] == '/' {
+			home = string(line[id+1:])
+			line = line[:id]
+		}
+
 		id1 := bytes.IndexByte(line, ':')
 		id2 := bytes.LastIndexByte(line, ':')
 		if id1 == -1 || id1 == id2 {
@@ -70,27 +88,15 @@ func NewFile(filename string) (a *File, err error) {
 		uname := ls[:id1]
 		pass := ls[id1+1 : id2]
 		mode := ls[id2+1:]
-		log.Printf("auth.NewFile: line %d: user=%s, len(pass)=%d, mode=%s", lnum, uname, len(pass), mode)
+		log.Printf("auth.NewFile: line %d: user=%s, len(pass)=%d, mode=%s, home=%s", lnum, uname, len(pass), mode, home)
 
 		switch mode {
 		case "rw":
 			// Read-Write
-			a.m[uname] = struct {
-				pass string
-				l    AccessType
-			}{
-				pass: pass,
-				l:    ReadWrite,
-			}
+			a.m[uname] = fileUser{pass: pass, l: ReadWrite, home: home}
 		case "r":
 			// Read-Only
-			a.m[uname] = struct {
-				pass string
-				l    AccessType
-			}{
-				pass: pass,
-				l:    ReadOnly,
-			}
+			a.m[uname] = fileUser{pass: pass, l: ReadOnly, home: home}
 		default:
 			log.Printf(`auth.NewFile: line %d format error (unknown mode "%s")`, lnum, mode)
 		}
@@ -1,7 +1,11 @@
 // Package auth provides basic system-wide authentication for ftpd.
 package auth
 
-import "strings"
+import (
+	"strings"
+
+	"github.com/Edgaru089/ftpd/mount"
+)
 
 // AccessType is an access level.
 type AccessType int
@@ -28,6 +32,16 @@ type Auth interface {
 	Login(username, password string) AccessType
 }
 
+// Root is an optional interface for an authenticator to give each user
+// their own root of the virtual filesystem.
+type Root interface {
+	// Root returns the filesystem root of a user after a successful
+	// Login: the Node to serve instead of the server one, or nil for
+	// the server one, and the folder on it to jail the user in, or
+	// empty for the whole Node.
+	Root(username string) (node mount.Node, home string)
+}
+
 // Anonymous is an authenticator that allows read-only login with the name "anonymous".
 type Anonymous struct{}
 
@@ -0,0 +1,165 @@
+package ftpd
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"strconv"
+)
+
+// This file houses the block mode (MODE B) framing of RFC 959 Section 3.4.2.
+//
+// Each block is a 1-byte descriptor, a 2-byte big-endian byte count, and
+// the data. The end of file is marked by the EOF descriptor bit instead of
+// the data connection being closed, so a truncated transfer is always
+// detected.
+
+// Block descriptor bits
+const (
+	BlockEOR     = 128 // End of data block is EOR
+	BlockEOF     = 64  // End of data block is EOF
+	BlockErrors  = 32  // Suspected errors in data block
+	BlockRestart = 16  // Data block is a restart marker
+)
+
+// Interval in bytes of the restart markers sent in block mode.
+const blockMarkerInterval = 1 << 20
+
+const blockMaxSize = 0xffff
+
+var errBlockMarker = errors.New("malformed block restart marker")
+
+// blockWriter frames the data written in blocks, with a restart marker of
+// the file offset every interval bytes, or none if interval is 0.
+//
+// Close must be called to send the EOF block. It does not close w.
+type blockWriter struct {
+	w          io.Writer
+	interval   int64
+	offset     int64 // Current file offset
+	nextMarker int64 // File offset for the next restart marker
+	header     [3]byte
+}
+
+func newBlockWriter(w io.Writer, offset, interval int64) *blockWriter {
+	return &blockWriter{w: w, interval: interval, offset: offset, nextMarker: offset + interval}
+}
+
+func (b *blockWriter) writeBlock(desc byte, data []byte) error {
+	b.header[0] = desc
+	binary.BigEndian.PutUint16(b.header[1:], uint16(len(data)))
+	if _, err := b.w.Write(b.header[:]); err != nil {
+		return err
+	}
+	if len(data) != 0 {
+		if _, err := b.w.Write(data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *blockWriter) Write(p []byte) (n int, err error) {
+	for len(p) != 0 {
+		size := len(p)
+		if size > blockMaxSize {
+			size = blockMaxSize
+		}
+		if left := b.nextMarker - b.offset; b.interval != 0 && int64(size) > left {
+			size = int(left)
+		}
+
+		if err = b.writeBlock(0, p[:size]); err != nil {
+			return
+		}
+		n += size
+		p = p[size:]
+		b.offset += int64(size)
+
+		if b.interval != 0 && b.offset == b.nextMarker {
+			// The marker is the file offset, which REST takes to restart
+			if err = b.writeBlock(BlockRestart, strconv.AppendInt(nil, b.offset, 10)); err != nil {
+				return
+			}
+			b.nextMarker += b.interval
+		}
+	}
+	return
+}
+
+// Close writes the EOF block.
+func (b *blockWriter) Close() error {
+	return b.writeBlock(BlockEOF, nil)
+}
+
+// blockReader reads the data in the blocks from r until the EOF block.
+//
+// Restart markers received are reported to the marker callback, if any,
+// which is called before any data in the following blocks is read.
+type blockReader struct {
+	r      io.Reader
+	marker func(marker string)
+
+	left   int  // Bytes left in the current block
+	eof    bool // The current block is the last one
+	header [3]byte
+}
+
+func newBlockReader(r io.Reader, marker func(marker string)) *blockReader {
+	return &blockReader{r: r, marker: marker}
+}
+
+func (b *blockReader) Read(p []byte) (n int, err error) {
+	for b.left == 0 {
+		if b.eof {
+			return 0, io.EOF
+		}
+
+		if _, err = io.ReadFull(b.r, b.header[:]); err != nil {
+			if err == io.EOF {
+				// Closed without the EOF block
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+		desc, size := b.header[0], int(binary.BigEndian.Uint16(b.header[1:]))
+		b.eof = desc&BlockEOF != 0
+
+		if desc&BlockRestart != 0 {
+			marker := make([]byte, size)
+			if _, err = io.ReadFull(b.r, marker); err != nil {
+				return 0, io.ErrUnexpectedEOF
+			}
+			if !validMarker(marker) {
+				return 0, errBlockMarker
+			}
+			if b.marker != nil {
+				b.marker(string(marker))
+			}
+			continue
+		}
+		// EOR and suspected error flags have no meaning for STRU F
+		b.left = size
+	}
+
+	if len(p) > b.left {
+		p = p[:b.left]
+	}
+	n, err = b.r.Read(p)
+	b.left -= n
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return
+}
+
+// validMarker reports if a restart marker is not empty and only of printable
+// characters, so that it can be sent back in a reply.
+func validMarker(marker []byte) bool {
+	for _, c := range marker {
+		if c < ' ' || c > '~' {
+			return false
+		}
+	}
+	return len(marker) != 0
+}
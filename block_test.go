@@ -0,0 +1,66 @@
+package ftpd
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+	"testing/iotest"
+)
+
+func TestBlockRoundTrip(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789"), 20000)
+
+	var buf bytes.Buffer
+	bw := newBlockWriter(&buf, 100, 65536)
+	if _, err := bw.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := bw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var markers []string
+	br := newBlockReader(iotest.HalfReader(&buf), func(marker string) {
+		markers = append(markers, marker)
+	})
+	got, err := ioutil.ReadAll(br)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("got %d bytes, want %d", len(got), len(data))
+	}
+
+	want := []string{"65636", "131172", "196708"}
+	if len(markers) != len(want) {
+		t.Fatalf("got markers %q, want %q", markers, want)
+	}
+	for i := range want {
+		if markers[i] != want[i] {
+			t.Errorf("got markers %q, want %q", markers, want)
+		}
+	}
+}
+
+func TestBlockReaderErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		err  error
+	}{
+		{"no EOF block", []byte{0, 0, 3, 'a', 'b', 'c'}, io.ErrUnexpectedEOF},
+		{"short block", []byte{BlockEOF, 0, 4, 'a', 'b'}, io.ErrUnexpectedEOF},
+		{"short header", []byte{BlockEOF, 0}, io.ErrUnexpectedEOF},
+		{"empty marker", []byte{BlockRestart, 0, 0, BlockEOF, 0, 0}, errBlockMarker},
+		{"bad marker", []byte{BlockRestart, 0, 2, '1', '\n', BlockEOF, 0, 0}, errBlockMarker},
+		{"EOR and EOF", []byte{BlockEOR, 0, 1, 'a', BlockEOR | BlockEOF, 0, 1, 'b'}, nil},
+	}
+
+	for _, tc := range tests {
+		_, err := ioutil.ReadAll(newBlockReader(bytes.NewReader(tc.data), nil))
+		if err != tc.err {
+			t.Errorf("%s: got error %v, want %v", tc.name, err, tc.err)
+		}
+	}
+}
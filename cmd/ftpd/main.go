@@ -1,10 +1,14 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"flag"
 	"log"
 	"os"
 	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/Edgaru089/ftpd"
 	"github.com/Edgaru089/ftpd/auth"
@@ -13,20 +17,36 @@ import (
 
 func main() {
 
-	var dir, ctrladdr, dataaddr, authfile, mountfile string
-	var port int
+	var dir, ctrladdr, dataaddr, pasvaddr, authfile, mountfile, certfile, keyfile string
+	var port, implicitport int
+	var shutdownTimeout time.Duration
 	flag.StringVar(&dir, "dir", ".", "root directory")
 	flag.IntVar(&port, "port", 21, "Control FTP Port")
 	flag.StringVar(&ctrladdr, "ctrl-addr", "0.0.0.0", "Control listen address")
 	flag.StringVar(&dataaddr, "data-addr", "0.0.0.0", "Data listen address")
+	flag.StringVar(&pasvaddr, "pasv-addr", "", "Passive mode address (IP or hostname) advertised to clients behind NAT")
 	flag.StringVar(&authfile, "auth-file", "", "auth file path, Anonymous if not present")
 	flag.StringVar(&mountfile, "mount-file", "", "mount file path, mounts working directory at root if not present")
+	flag.StringVar(&certfile, "cert", "", "TLS certificate file path, enables FTPS with -key")
+	flag.StringVar(&keyfile, "key", "", "TLS private key file path, enables FTPS with -cert")
+	flag.IntVar(&implicitport, "implicit-tls-port", 0, "Implicit FTPS Control Port (usually 990), disabled if 0")
+	flag.DurationVar(&shutdownTimeout, "shutdown-timeout", 30*time.Second, "Time to wait for running transfers on shutdown")
 	flag.Parse()
 
 	s := &ftpd.Server{
-		Port:        port,
-		Address:     ctrladdr,
-		DataAddress: dataaddr,
+		Port:            port,
+		Address:         ctrladdr,
+		DataAddress:     dataaddr,
+		PassiveAddress:  pasvaddr,
+		ImplicitTLSPort: implicitport,
+	}
+
+	if len(certfile) != 0 || len(keyfile) != 0 {
+		cert, err := tls.LoadX509KeyPair(certfile, keyfile)
+		if err != nil {
+			log.Fatal("ftpd TLS certificate error: ", err)
+		}
+		s.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
 	}
 
 	if len(authfile) != 0 {
@@ -49,11 +69,17 @@ func main() {
 		log.Fatal("ftpd start error: ", err)
 	}
 
-	ch := make(chan os.Signal)
-	signal.Notify(ch, os.Interrupt)
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, os.Interrupt, syscall.SIGTERM)
 	<-ch
 
-	s.Stop()
+	log.Print("Shutting down, waiting for transfers to complete...")
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		log.Print("Shutdown timed out, connections closed: ", err)
+		return
+	}
 
 	log.Print("A graceful shutdown. Thank you.")
 
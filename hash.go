@@ -0,0 +1,176 @@
+package ftpd
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"hash"
+	"hash/crc32"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Edgaru089/ftpd/mount"
+)
+
+// This file houses the file checksums for HASH (draft-bryan-ftpext-hash)
+// and the legacy XCRC/XMD5/XSHA1/XSHA256/XSHA512 commands.
+
+// Hash algorithms by their names in HASH, in the order advertised in FEAT.
+var hashAlgorithms = []struct {
+	name string
+	new  func() hash.Hash
+}{
+	{"SHA-1", sha1.New},
+	{"SHA-256", sha256.New},
+	{"SHA-512", sha512.New},
+	{"MD5", md5.New},
+	{"CRC32", func() hash.Hash { return crc32.NewIEEE() }},
+}
+
+// The algorithm selected before any OPTS HASH.
+const defaultHashAlgorithm = "SHA-1"
+
+func findHashAlgorithm(name string) func() hash.Hash {
+	for _, alg := range hashAlgorithms {
+		if alg.name == name {
+			return alg.new
+		}
+	}
+	return nil
+}
+
+// hashFeature returns the HASH line in FEAT, with the selected
+// algorithm marked by a '*'.
+func hashFeature(selected string) string {
+	var b strings.Builder
+	b.WriteString(" HASH ")
+	for i, alg := range hashAlgorithms {
+		if i != 0 {
+			b.WriteByte(';')
+		}
+		b.WriteString(alg.name)
+		if alg.name == selected {
+			b.WriteByte('*')
+		}
+	}
+	b.WriteString("\r\n")
+	return b.String()
+}
+
+type hashKey struct {
+	root       interface{} // Root Node of the session, as users can have their own
+	file, alg  string
+	start, end int64
+}
+
+type hashEntry struct {
+	size   int64
+	modify time.Time
+	sum    string
+}
+
+// hashCache caches checksums, which are valid as long as the size and the
+// modification time of the file are the same.
+type hashCache struct {
+	lock    sync.Mutex
+	entries map[hashKey]hashEntry
+}
+
+func (c *hashCache) get(key hashKey, stat mount.File) (sum string, ok bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	e, ok := c.entries[key]
+	if !ok || e.size != stat.Size || !e.modify.Equal(stat.LastModify) {
+		return "", false
+	}
+	return e.sum, true
+}
+
+func (c *hashCache) put(key hashKey, stat mount.File, sum string, max int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.entries == nil {
+		c.entries = make(map[hashKey]hashEntry)
+	}
+	if _, ok := c.entries[key]; !ok && len(c.entries) >= max {
+		for k := range c.entries { // Evict a random one
+			delete(c.entries, k)
+			break
+		}
+	}
+	c.entries[key] = hashEntry{size: stat.Size, modify: stat.LastModify, sum: sum}
+}
+
+// fileHash returns the hex checksum of the bytes from start to end
+// (inclusive) of file on node, with the hash algorithm alg. An end of -1 or past
+// the end of file means up to the end of file, and the actual end is
+// returned.
+//
+// It returns mount.ErrNotFolder if file is a folder, and
+// mount.ErrInvalidOffset if start is past the end of file.
+func (s *Server) fileHash(node mount.Node, file, alg string, start, end int64) (sum string, rangeEnd int64, err error) {
+	newHash := findHashAlgorithm(alg)
+	if newHash == nil {
+		return "", 0, mount.ErrNotSupported
+	}
+
+	stat, err := node.Stat(file)
+	if err != nil {
+		return "", 0, err
+	}
+	if stat.IsDirectory {
+		return "", 0, mount.ErrNotFolder
+	}
+	if start > stat.Size || (start == stat.Size && start != 0) {
+		return "", 0, mount.ErrInvalidOffset
+	}
+	if end < 0 || end >= stat.Size {
+		end = stat.Size - 1
+	}
+	if end < start { // Empty file
+		end = start
+	}
+
+	key := hashKey{root: node, file: file, alg: alg, start: start, end: end}
+	if chroot, ok := node.(*mount.NodeChroot); ok {
+		// Each session of a user has its own, but of the same folder
+		key.root = *chroot
+	}
+	if s.HashCacheSize > 0 {
+		if sum, ok := s.hashCache.get(key, stat); ok {
+			return sum, end, nil
+		}
+	}
+
+	r, err := mount.ReadFileAt(node, file, start)
+	if err != nil {
+		return "", 0, err
+	}
+	if closer, ok := r.(io.Closer); ok {
+		defer closer.Close()
+	}
+
+	h := newHash()
+	if _, err = io.Copy(h, io.LimitReader(r, end-start+1)); err != nil {
+		return "", 0, err
+	}
+	sum = hex.EncodeToString(h.Sum(nil))
+
+	if s.HashCacheSize > 0 {
+		s.hashCache.put(key, stat, sum, s.HashCacheSize)
+	}
+	return sum, end, nil
+}
+
+// Hash algorithms of the legacy checksum commands.
+var legacyHashCommands = map[string]string{
+	"XCRC":    "CRC32",
+	"XMD5":    "MD5",
+	"XSHA1":   "SHA-1",
+	"XSHA256": "SHA-256",
+	"XSHA512": "SHA-512",
+}
@@ -0,0 +1,44 @@
+package ftpd
+
+import (
+	"testing"
+
+	"github.com/Edgaru089/ftpd/mount"
+)
+
+func TestHashCache(t *testing.T) {
+	node := &mount.NodeMemory{}
+	putFile(t, node, "/a", "hello world")
+	s := &Server{Node: node, HashCacheSize: 1}
+
+	sum, end, err := s.fileHash(node, "/a", "MD5", 0, -1)
+	if err != nil || end != 10 || sum != "5eb63bbbe01eeed093cb22bb8f5acdc3" {
+		t.Fatalf("got %s, %d, %v", sum, end, err)
+	}
+
+	// Served from the cache while the size and time stay the same
+	stat, _ := node.Stat("/a")
+	putFile(t, node, "/a", "HELLO WORLD")
+	node.SetModTime("/a", stat.LastModify)
+	if sum, _, _ := s.fileHash(node, "/a", "MD5", 0, -1); sum != "5eb63bbbe01eeed093cb22bb8f5acdc3" {
+		t.Errorf("got %s, not the cached sum", sum)
+	}
+
+	putFile(t, node, "/a", "hello")
+	if sum, _, _ := s.fileHash(node, "/a", "MD5", 0, -1); sum != "5d41402abc4b2a76b9719d911017c592" {
+		t.Errorf("got %s after the size changed", sum)
+	}
+
+	// Evicted by another entry
+	s.fileHash(node, "/a", "CRC32", 0, -1)
+	if len(s.hashCache.entries) != 1 {
+		t.Errorf("got %d cache entries, want 1", len(s.hashCache.entries))
+	}
+
+	if _, _, err := s.fileHash(node, "/", "MD5", 0, -1); err == nil {
+		t.Error("hashing a folder succeeded")
+	}
+	if _, _, err := s.fileHash(node, "/a", "MD5", 5, -1); err == nil {
+		t.Error("hashing past the end of file succeeded")
+	}
+}
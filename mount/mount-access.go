@@ -0,0 +1,138 @@
+package mount
+
+import (
+	"io"
+	"time"
+)
+
+// Access is what a Node allows to be done to its files, reported in
+// File.Access.
+type Access int
+
+// Access limits
+const (
+	AccessAny       Access = iota // Not limited
+	AccessReadOnly                // Files can be listed and read, but not changed
+	AccessWriteOnly               // New files can be stored, but not listed or read
+)
+
+// NodeReadOnly is a Node wrapping another one, denying any change to it
+// with ErrNoPermission whatever the access level of the user.
+type NodeReadOnly struct {
+	Node Node
+}
+
+var _ Node = &NodeReadOnly{}
+var _ NodeWriteAt = &NodeReadOnly{}
+var _ NodeCreateFile = &NodeReadOnly{}
+var _ NodeSetModTime = &NodeReadOnly{}
+
+// ReadOnly returns n wrapped in a NodeReadOnly.
+func ReadOnly(n Node) *NodeReadOnly {
+	return &NodeReadOnly{Node: n}
+}
+
+func (n *NodeReadOnly) Name() string { return "ro:" + n.Node.Name() }
+
+func (n *NodeReadOnly) List(folder string) ([]File, error) {
+	files, err := n.Node.List(folder)
+	for i := range files {
+		files[i].Access = AccessReadOnly
+	}
+	return files, err
+}
+
+func (n *NodeReadOnly) Stat(file string) (File, error) {
+	stat, err := n.Node.Stat(file)
+	if err == nil {
+		stat.Access = AccessReadOnly
+	}
+	return stat, err
+}
+
+func (n *NodeReadOnly) ReadFile(file string) (io.Reader, error) { return n.Node.ReadFile(file) }
+
+func (n *NodeReadOnly) WriteFile(file string) (io.Writer, error) { return nil, ErrNoPermission }
+func (n *NodeReadOnly) WriteFileAt(file string, offset int64) (io.Writer, error) {
+	return nil, ErrNoPermission
+}
+func (n *NodeReadOnly) CreateFile(file string) (io.Writer, error) { return nil, ErrNoPermission }
+func (n *NodeReadOnly) AppendFile(file string) (io.Writer, error) { return nil, ErrNoPermission }
+func (n *NodeReadOnly) DeleteFile(file string) error              { return ErrNoPermission }
+func (n *NodeReadOnly) MakeDirectory(dir string) error            { return ErrNoPermission }
+func (n *NodeReadOnly) RemoveDirectory(dir string) error          { return ErrNoPermission }
+func (n *NodeReadOnly) Rename(from, to string) error              { return ErrNoPermission }
+func (n *NodeReadOnly) SetModTime(file string, t time.Time) error { return ErrNoPermission }
+
+// NodeWriteOnly is a Node wrapping another one as a drop box: new files
+// and folders can be uploaded into it, but nothing can be listed, read,
+// replaced or removed. Only folders can be stat'ed, so that the client can
+// change into them.
+type NodeWriteOnly struct {
+	Node Node
+}
+
+var _ Node = &NodeWriteOnly{}
+var _ NodeWriteAt = &NodeWriteOnly{}
+var _ NodeCreateFile = &NodeWriteOnly{}
+var _ NodeSetModTime = &NodeWriteOnly{}
+
+// WriteOnly returns n wrapped in a NodeWriteOnly.
+func WriteOnly(n Node) *NodeWriteOnly {
+	return &NodeWriteOnly{Node: n}
+}
+
+func (n *NodeWriteOnly) Name() string { return "wo:" + n.Node.Name() }
+
+func (n *NodeWriteOnly) List(folder string) ([]File, error) { return nil, ErrNoPermission }
+
+func (n *NodeWriteOnly) Stat(file string) (File, error) {
+	stat, err := n.Node.Stat(file)
+	if err != nil || !stat.IsDirectory {
+		return File{}, ErrNoPermission
+	}
+	stat.Access = AccessWriteOnly
+	return stat, nil
+}
+
+func (n *NodeWriteOnly) ReadFile(file string) (io.Reader, error) { return nil, ErrNoPermission }
+
+// WriteFile stores a new file, but does not replace an existing one.
+func (n *NodeWriteOnly) WriteFile(file string) (io.Writer, error) {
+	return n.CreateFile(file)
+}
+
+// WriteFileAt only stores a new file from the start, as restarting an
+// upload would replace the existing file.
+func (n *NodeWriteOnly) WriteFileAt(file string, offset int64) (io.Writer, error) {
+	if offset != 0 {
+		return nil, ErrNoPermission
+	}
+	return n.CreateFile(file)
+}
+
+// CreateFile stores a new file, failing with ErrFileFound if it exists,
+// so that STOU can pick another name.
+func (n *NodeWriteOnly) CreateFile(file string) (io.Writer, error) {
+	w, err := CreateFile(n.Node, file)
+	if err != ErrNotSupported {
+		return w, err
+	}
+
+	// Racy, but the best without the Node's help
+	switch _, err = n.Node.Stat(file); err {
+	case nil:
+		return nil, ErrFileFound
+	case ErrFileNotFound:
+		return n.Node.WriteFile(file)
+	default:
+		return nil, err
+	}
+}
+
+func (n *NodeWriteOnly) AppendFile(file string) (io.Writer, error) { return nil, ErrNoPermission }
+func (n *NodeWriteOnly) DeleteFile(file string) error              { return ErrNoPermission }
+func (n *NodeWriteOnly) MakeDirectory(dir string) error            { return n.Node.MakeDirectory(dir) }
+func (n *NodeWriteOnly) RemoveDirectory(dir string) error          { return ErrNoPermission }
+func (n *NodeWriteOnly) Rename(from, to string) error              { return ErrNoPermission }
+func (n *NodeWriteOnly) SetModTime(file string, t time.Time) error { return ErrNoPermission }
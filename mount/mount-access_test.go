@@ -0,0 +1,140 @@
+package mount
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadOnly(t *testing.T) {
+	mem := &NodeMemory{}
+	w, _ := mem.WriteFile("a")
+	io.WriteString(w, "hello")
+	n := ReadOnly(mem)
+
+	if got := readAll(t, n, "a"); got != "hello" {
+		t.Errorf("ReadFile got %q", got)
+	}
+	if files, err := n.List("/"); err != nil || len(files) != 1 || files[0].Access != AccessReadOnly {
+		t.Errorf("List got %v, %v", files, err)
+	}
+	if stat, err := n.Stat("a"); err != nil || stat.Access != AccessReadOnly {
+		t.Errorf("Stat got %+v, %v", stat, err)
+	}
+	if _, err := n.WriteFile("b"); err != ErrNoPermission {
+		t.Errorf("WriteFile got %v", err)
+	}
+	if _, err := WriteFileAt(n, "a", 1); err != ErrNoPermission {
+		t.Errorf("WriteFileAt got %v", err)
+	}
+	if _, err := CreateFile(n, "b"); err != ErrNoPermission {
+		t.Errorf("CreateFile got %v", err)
+	}
+	if err := n.DeleteFile("a"); err != ErrNoPermission {
+		t.Errorf("DeleteFile got %v", err)
+	}
+	if err := n.MakeDirectory("d"); err != ErrNoPermission {
+		t.Errorf("MakeDirectory got %v", err)
+	}
+	if err := n.Rename("a", "b"); err != ErrNoPermission {
+		t.Errorf("Rename got %v", err)
+	}
+}
+
+func TestWriteOnly(t *testing.T) {
+	mem := &NodeMemory{}
+	n := WriteOnly(mem)
+
+	if err := n.MakeDirectory("d"); err != nil {
+		t.Fatal(err)
+	}
+	if stat, err := n.Stat("d"); err != nil || !stat.IsDirectory || stat.Access != AccessWriteOnly {
+		t.Errorf("Stat on a folder got %+v, %v", stat, err)
+	}
+	w, err := n.WriteFile("d/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(w, "secret")
+	if got := readAll(t, mem, "d/a"); got != "secret" {
+		t.Errorf("stored %q", got)
+	}
+
+	if _, err := n.Stat("d/a"); err != ErrNoPermission {
+		t.Errorf("Stat on a file got %v", err)
+	}
+	if _, err := n.ReadFile("d/a"); err != ErrNoPermission {
+		t.Errorf("ReadFile got %v", err)
+	}
+	if _, err := n.List("d"); err != ErrNoPermission {
+		t.Errorf("List got %v", err)
+	}
+	if _, err := n.WriteFile("d/a"); err != ErrFileFound {
+		t.Errorf("replacing a file got %v", err)
+	}
+	if _, err := WriteFileAt(n, "d/a", 3); err != ErrNoPermission {
+		t.Errorf("WriteFileAt got %v", err)
+	}
+	if _, err := n.AppendFile("d/a"); err != ErrNoPermission {
+		t.Errorf("AppendFile got %v", err)
+	}
+	if err := n.DeleteFile("d/a"); err != ErrNoPermission {
+		t.Errorf("DeleteFile got %v", err)
+	}
+
+	// Without NodeCreateFile on the wrapped Node
+	n = WriteOnly(struct{ Node }{mem})
+	if _, err := n.WriteFile("d/a"); err != ErrFileFound {
+		t.Errorf("replacing a file without CreateFile got %v", err)
+	}
+	if _, err := n.WriteFile("d/b"); err != nil {
+		t.Errorf("WriteFile without CreateFile got %v", err)
+	}
+}
+
+func TestMountFileAccess(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mount")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "a"), []byte("hello"), 0644)
+
+	mountfile := filepath.Join(dir, ".mounts")
+	ioutil.WriteFile(mountfile, []byte("/ro:"+dir+":ro\n/in:"+dir+":wo,hide=.*\n/both:"+dir+":ro,wo\n"), 0644)
+
+	tree, err := NewNodeTreeFromFile(mountfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readAll(t, tree, "/ro/a"); got != "hello" {
+		t.Errorf("ReadFile on ro got %q", got)
+	}
+	if _, err := tree.WriteFile("/ro/b"); err != ErrNoPermission {
+		t.Errorf("WriteFile on ro got %v", err)
+	}
+
+	if _, err := tree.List("/in"); err != ErrNoPermission {
+		t.Errorf("List on wo got %v", err)
+	}
+	if _, err := tree.WriteFile("/in/.b"); err != ErrNoPermission {
+		t.Errorf("WriteFile of a hidden file on wo got %v", err)
+	}
+	w, err := tree.WriteFile("/in/b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c, ok := w.(io.Closer); ok {
+		c.Close()
+	}
+	if _, err := os.Stat(filepath.Join(dir, "b")); err != nil {
+		t.Errorf("WriteFile on wo: %v", err)
+	}
+
+	// Conflicting options are taken as part of the folder name
+	if _, err := tree.Stat("/both/a"); err == nil {
+		t.Error("mounted with both ro and wo")
+	}
+}
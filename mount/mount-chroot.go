@@ -0,0 +1,85 @@
+package mount
+
+import (
+	"io"
+	"path"
+	"time"
+)
+
+// NodeChroot is a Node serving a folder of another one as its root.
+// Paths cannot escape the folder, as ".." at the root stays there.
+//
+// NodeChroot values are comparable, and equal if serving the same folder.
+type NodeChroot struct {
+	Node Node
+	Dir  string // Folder on Node, cleaned and absolute
+}
+
+var _ Node = &NodeChroot{}
+var _ NodeWriteAt = &NodeChroot{}
+var _ NodeCreateFile = &NodeChroot{}
+var _ NodeSetModTime = &NodeChroot{}
+
+// Chroot returns a NodeChroot serving the folder dir of n.
+func Chroot(n Node, dir string) *NodeChroot {
+	return &NodeChroot{Node: n, Dir: path.Clean("/" + dir)}
+}
+
+// path returns the path of file on n.Node.
+func (n *NodeChroot) path(file string) string {
+	return path.Join(n.Dir, path.Clean("/"+file))
+}
+
+func (n *NodeChroot) Name() string { return "chroot:" + n.Dir + ":" + n.Node.Name() }
+
+func (n *NodeChroot) List(folder string) ([]File, error) { return n.Node.List(n.path(folder)) }
+
+func (n *NodeChroot) Stat(file string) (File, error) {
+	stat, err := n.Node.Stat(n.path(file))
+	if err == nil && path.Clean("/"+file) == "/" {
+		stat.Name = "/"
+	}
+	return stat, err
+}
+
+func (n *NodeChroot) ReadFile(file string) (io.Reader, error) {
+	return n.Node.ReadFile(n.path(file))
+}
+
+func (n *NodeChroot) WriteFile(file string) (io.Writer, error) {
+	return n.Node.WriteFile(n.path(file))
+}
+
+func (n *NodeChroot) WriteFileAt(file string, offset int64) (io.Writer, error) {
+	return WriteFileAt(n.Node, n.path(file), offset)
+}
+
+func (n *NodeChroot) CreateFile(file string) (io.Writer, error) {
+	return CreateFile(n.Node, n.path(file))
+}
+
+func (n *NodeChroot) AppendFile(file string) (io.Writer, error) {
+	return n.Node.AppendFile(n.path(file))
+}
+
+func (n *NodeChroot) DeleteFile(file string) error { return n.Node.DeleteFile(n.path(file)) }
+
+func (n *NodeChroot) MakeDirectory(dir string) error { return n.Node.MakeDirectory(n.path(dir)) }
+
+func (n *NodeChroot) RemoveDirectory(dir string) error {
+	if path.Clean("/"+dir) == "/" {
+		return ErrNoPermission
+	}
+	return n.Node.RemoveDirectory(n.path(dir))
+}
+
+func (n *NodeChroot) Rename(from, to string) error {
+	if path.Clean("/"+from) == "/" {
+		return ErrNoPermission
+	}
+	return n.Node.Rename(n.path(from), n.path(to))
+}
+
+func (n *NodeChroot) SetModTime(file string, t time.Time) error {
+	return SetModTime(n.Node, n.path(file), t)
+}
@@ -0,0 +1,49 @@
+package mount
+
+import (
+	"io"
+	"testing"
+)
+
+func TestChroot(t *testing.T) {
+	mem := &NodeMemory{}
+	mem.MakeDirectory("home/alice")
+	w, _ := mem.WriteFile("secret")
+	io.WriteString(w, "secret")
+	n := Chroot(mem, "home/alice/")
+
+	if n.Dir != "/home/alice" {
+		t.Errorf("got Dir %q", n.Dir)
+	}
+	w, err := n.WriteFile("../../a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(w, "a")
+	if got := readAll(t, mem, "home/alice/a.txt"); got != "a" {
+		t.Errorf("got %q", got)
+	}
+	if _, err := n.ReadFile("../../secret"); err != ErrFileNotFound {
+		t.Errorf("ReadFile outside got %v", err)
+	}
+	if files, _ := n.List("/.."); len(files) != 1 || files[0].Name != "a.txt" {
+		t.Errorf("List got %v", files)
+	}
+	if stat, err := n.Stat("/"); err != nil || !stat.IsDirectory || stat.Name != "/" {
+		t.Errorf("Stat got %+v, %v", stat, err)
+	}
+
+	if err := n.RemoveDirectory("/"); err != ErrNoPermission {
+		t.Errorf("RemoveDirectory of the root got %v", err)
+	}
+	if err := n.Rename("a.txt", "../b.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if got := readAll(t, mem, "home/alice/b.txt"); got != "a" {
+		t.Errorf("got %q after Rename", got)
+	}
+
+	if *n != *Chroot(mem, "/home/alice") {
+		t.Error("NodeChroot values of the same folder differ")
+	}
+}
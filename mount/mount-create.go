@@ -0,0 +1,23 @@
+package mount
+
+import "io"
+
+// NodeCreateFile is an optional interface for a Node to create new files
+// atomically, never overwriting an existing one.
+type NodeCreateFile interface {
+	// CreateFile returns a io.Writer that stores a new file under
+	// this directory, failing with ErrFileFound if it already exists.
+	//
+	// If the returned Writer satifies io.Closer, the file is
+	// closed after use.
+	CreateFile(file string) (io.Writer, error)
+}
+
+// CreateFile creates a new file on n exclusively, returning ErrNotSupported
+// if n does not implement NodeCreateFile.
+func CreateFile(n Node, file string) (io.Writer, error) {
+	if nc, ok := n.(NodeCreateFile); ok {
+		return nc.CreateFile(file)
+	}
+	return nil, ErrNotSupported
+}
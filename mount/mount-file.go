@@ -3,8 +3,14 @@ package mount
 import (
 	"bufio"
 	"bytes"
+	"fmt"
 	"log"
+	"math"
 	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
 )
 
 // NewNodeTreeFromFile creates a new node tree, with multiple system
@@ -13,9 +19,26 @@ import (
 // The file is composed of lines that are empty, begin with #,
 // or are of the following format:
 //
-//    [VFS mount target path]:[System folder path]
+//    [VFS mount target path]:[System folder path][:options]
 //
 // A TVFS path does not have colons so the first colon ends the target.
+// The folder ":memory:" mounts an empty NodeMemory instead of a system
+// folder, whose files are lost on exit.
+// The options are a comma-separated list of the following:
+//
+//    hide=[glob]      Hide files matching the path.Match pattern
+//    hidere=[regexp]  Hide files matching the regular expression
+//    symlinks=[policy] Symlink policy of the folder: "within" (default) to
+//                      follow symlinks inside the folder, "follow", "hide"
+//                      or "link" to list them as links
+//    maxsize=[size]   Total size limit of a memory folder, in bytes or
+//                     with a K, M or G suffix
+//    ro               Read-only, whatever the access level of the user
+//    wo               Write-only, as a drop box for uploads
+//
+// for example "/share:/srv/share:hide=.*,hide=Thumbs.db",
+// "/incoming:/srv/in:wo" or "/tmp::memory::maxsize=64M". The text after
+// the last colon is only taken as options if it is valid ones.
 func NewNodeTreeFromFile(filename string) (t *NodeTree, err error) {
 	var f *os.File
 	f, err = os.Open(filename)
@@ -44,9 +67,20 @@ func NewNodeTreeFromFile(filename string) (t *NodeTree, err error) {
 		ls := string(line)
 		target := ls[:id]
 		folder := ls[id+1:]
-		log.Printf(`mount.NewTreeFile: line %d: target="%s", folder="%s"`, lnum, target, folder)
 
-		err := t.Mount(target, &NodeSysFolder{Path: folder})
+		n := folderNode(target, folder)
+		// A path may contain ':' too, like a Windows drive, so it is kept
+		// whole if the options are bad
+		if id := strings.LastIndexByte(folder, ':'); id > 1 && id != len(folder)-1 && folder != memoryFolder {
+			if wrapped, err := mountOptions(folderNode(target, folder[:id]), folder[id+1:]); err == nil {
+				n, folder = wrapped, folder[:id]
+			} else {
+				log.Printf("mount.NewTreeFile: line %d: bad options, taken as part of the folder: %s", lnum, err.Error())
+			}
+		}
+		log.Printf(`mount.NewTreeFile: line %d: target="%s", folder="%s", node=%s`, lnum, target, folder, n.Name())
+
+		err := t.Mount(target, n)
 		if err != nil {
 			log.Printf("mount.NewTreeFile: line %d: mount error: %s", lnum, err.Error())
 		}
@@ -54,3 +88,118 @@ func NewNodeTreeFromFile(filename string) (t *NodeTree, err error) {
 
 	return
 }
+
+// The folder of a mount file line mounting a NodeMemory.
+const memoryFolder = ":memory:"
+
+// folderNode returns the Node for the folder of a mount file line.
+func folderNode(target, folder string) Node {
+	if folder == memoryFolder {
+		return &NodeMemory{NodeName: target}
+	}
+	return &NodeSysFolder{Path: folder}
+}
+
+// mountOptions wraps n with the Nodes for the options of a mount file line.
+func mountOptions(n Node, options string) (Node, error) {
+	var filter NodeFilter
+	var readOnly, writeOnly bool
+	for _, opt := range strings.Split(options, ",") {
+		switch opt {
+		case "ro":
+			readOnly = true
+			continue
+		case "wo":
+			writeOnly = true
+			continue
+		}
+
+		id := strings.IndexByte(opt, '=')
+		if id == -1 {
+			return nil, fmt.Errorf("unknown option %q", opt)
+		}
+		switch key, value := opt[:id], opt[id+1:]; key {
+		case "hide":
+			if _, err := path.Match(value, ""); err != nil {
+				return nil, err
+			}
+			filter.Globs = append(filter.Globs, value)
+		case "hidere":
+			re, err := regexp.Compile(value)
+			if err != nil {
+				return nil, err
+			}
+			filter.Regexps = append(filter.Regexps, re)
+		case "symlinks":
+			sys, ok := n.(*NodeSysFolder)
+			if !ok {
+				return nil, fmt.Errorf("option %q only applies to system folders", key)
+			}
+			policy, ok := symlinkPolicies[value]
+			if !ok {
+				return nil, fmt.Errorf("unknown symlink policy %q", value)
+			}
+			sys.Symlinks = policy
+		case "maxsize":
+			mem, ok := n.(*NodeMemory)
+			if !ok {
+				return nil, fmt.Errorf("option %q only applies to memory folders", key)
+			}
+			size, err := parseSize(value)
+			if err != nil {
+				return nil, err
+			}
+			mem.MaxSize = size
+		default:
+			return nil, fmt.Errorf("unknown option %q", opt)
+		}
+	}
+
+	if readOnly && writeOnly {
+		return nil, fmt.Errorf("options %q and %q conflict", "ro", "wo")
+	}
+
+	if len(filter.Globs) != 0 || len(filter.Regexps) != 0 {
+		filter.Node = n
+		n = &filter
+	}
+	if readOnly {
+		n = ReadOnly(n)
+	}
+	if writeOnly {
+		n = WriteOnly(n)
+	}
+	return n, nil
+}
+
+// Symlink policies by their names in the mount file
+var symlinkPolicies = map[string]SymlinkPolicy{
+	"within": SymlinkFollowWithinRoot,
+	"follow": SymlinkFollow,
+	"hide":   SymlinkHide,
+	"link":   SymlinkShowAsLink,
+}
+
+// parseSize parses a size in bytes, with an optional K, M or G suffix.
+func parseSize(s string) (int64, error) {
+	shift := uint(0)
+	if len(s) != 0 {
+		switch s[len(s)-1] {
+		case 'K', 'k':
+			shift = 10
+		case 'M', 'm':
+			shift = 20
+		case 'G', 'g':
+			shift = 30
+		}
+		if shift != 0 {
+			s = s[:len(s)-1]
+		}
+	}
+
+	size, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || size < 0 || size > math.MaxInt64>>shift {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return size << shift, nil
+}
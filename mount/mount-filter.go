@@ -0,0 +1,164 @@
+package mount
+
+import (
+	"io"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// NodeFilter is a Node wrapping another one, hiding the files with a
+// name matching any of its patterns as if they did not exist. They are
+// not listed, and cannot be opened, stat'ed, created or renamed, nor
+// can anything under a hidden folder.
+type NodeFilter struct {
+	Node Node
+
+	// Globs are patterns of path.Match, like ".*" or "*.swp".
+	Globs []string
+	// Regexps are matched against the name, like `^~\$`.
+	Regexps []*regexp.Regexp
+}
+
+var _ Node = &NodeFilter{}
+var _ NodeWriteAt = &NodeFilter{}
+var _ NodeCreateFile = &NodeFilter{}
+var _ NodeSetModTime = &NodeFilter{}
+
+// Hide returns a NodeFilter hiding the files on n with names matching
+// any of the glob patterns, which fails with path.ErrBadPattern if a
+// pattern is malformed.
+func Hide(n Node, globs ...string) (*NodeFilter, error) {
+	for _, glob := range globs {
+		if _, err := path.Match(glob, ""); err != nil {
+			return nil, err
+		}
+	}
+	return &NodeFilter{Node: n, Globs: globs}, nil
+}
+
+// Hidden reports if a file name is hidden by the filter.
+func (n *NodeFilter) Hidden(name string) bool {
+	for _, glob := range n.Globs {
+		if ok, _ := path.Match(glob, name); ok {
+			return true
+		}
+	}
+	for _, re := range n.Regexps {
+		if re.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// hiddenPath reports if any element of the path is hidden.
+func (n *NodeFilter) hiddenPath(file string) bool {
+	for _, name := range strings.Split(file, "/") {
+		if len(name) != 0 && n.Hidden(name) {
+			return true
+		}
+	}
+	return false
+}
+
+func (n *NodeFilter) Name() string { return "filter:" + n.Node.Name() }
+
+func (n *NodeFilter) List(folder string) ([]File, error) {
+	if n.hiddenPath(folder) {
+		return nil, ErrFileNotFound
+	}
+	files, err := n.Node.List(folder)
+	if err != nil {
+		return nil, err
+	}
+
+	shown := make([]File, 0, len(files))
+	for _, f := range files {
+		if !n.Hidden(f.Name) {
+			shown = append(shown, f)
+		}
+	}
+	return shown, nil
+}
+
+func (n *NodeFilter) Stat(file string) (File, error) {
+	if n.hiddenPath(file) {
+		return File{}, ErrFileNotFound
+	}
+	return n.Node.Stat(file)
+}
+
+func (n *NodeFilter) ReadFile(file string) (io.Reader, error) {
+	if n.hiddenPath(file) {
+		return nil, ErrFileNotFound
+	}
+	return n.Node.ReadFile(file)
+}
+
+func (n *NodeFilter) WriteFile(file string) (io.Writer, error) {
+	if n.hiddenPath(file) {
+		return nil, ErrNoPermission
+	}
+	return n.Node.WriteFile(file)
+}
+
+func (n *NodeFilter) WriteFileAt(file string, offset int64) (io.Writer, error) {
+	if n.hiddenPath(file) {
+		return nil, ErrNoPermission
+	}
+	return WriteFileAt(n.Node, file, offset)
+}
+
+func (n *NodeFilter) CreateFile(file string) (io.Writer, error) {
+	if n.hiddenPath(file) {
+		return nil, ErrNoPermission
+	}
+	return CreateFile(n.Node, file)
+}
+
+func (n *NodeFilter) AppendFile(file string) (io.Writer, error) {
+	if n.hiddenPath(file) {
+		return nil, ErrNoPermission
+	}
+	return n.Node.AppendFile(file)
+}
+
+func (n *NodeFilter) DeleteFile(file string) error {
+	if n.hiddenPath(file) {
+		return ErrFileNotFound
+	}
+	return n.Node.DeleteFile(file)
+}
+
+func (n *NodeFilter) MakeDirectory(dir string) error {
+	if n.hiddenPath(dir) {
+		return ErrNoPermission
+	}
+	return n.Node.MakeDirectory(dir)
+}
+
+func (n *NodeFilter) RemoveDirectory(dir string) error {
+	if n.hiddenPath(dir) {
+		return ErrFileNotFound
+	}
+	return n.Node.RemoveDirectory(dir)
+}
+
+func (n *NodeFilter) Rename(from, to string) error {
+	if n.hiddenPath(from) {
+		return ErrFileNotFound
+	}
+	if n.hiddenPath(to) {
+		return ErrNoPermission
+	}
+	return n.Node.Rename(from, to)
+}
+
+func (n *NodeFilter) SetModTime(file string, t time.Time) error {
+	if n.hiddenPath(file) {
+		return ErrFileNotFound
+	}
+	return SetModTime(n.Node, file, t)
+}
@@ -0,0 +1,91 @@
+package mount
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+)
+
+func TestNodeFilter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mount")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	os.MkdirAll(filepath.Join(dir, ".git", "objects"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, ".git", "HEAD"), nil, 0644)
+	ioutil.WriteFile(filepath.Join(dir, "a.txt"), nil, 0644)
+	ioutil.WriteFile(filepath.Join(dir, "a.txt.swp"), nil, 0644)
+	ioutil.WriteFile(filepath.Join(dir, "~$doc.docx"), nil, 0644)
+
+	n, err := Hide(&NodeSysFolder{Path: dir}, ".git", "*.swp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.Regexps = []*regexp.Regexp{regexp.MustCompile(`^~\$`)}
+
+	files, err := n.List("")
+	if err != nil || len(files) != 1 || files[0].Name != "a.txt" {
+		t.Errorf("List got %v, %v", files, err)
+	}
+	for _, file := range []string{".git", ".git/HEAD", "a.txt.swp", "~$doc.docx"} {
+		if _, err := n.Stat(file); err != ErrFileNotFound {
+			t.Errorf("Stat %s got %v", file, err)
+		}
+		if _, err := n.ReadFile(file); err != ErrFileNotFound {
+			t.Errorf("ReadFile %s got %v", file, err)
+		}
+	}
+	if _, err := n.List(".git/objects"); err != ErrFileNotFound {
+		t.Errorf("List .git/objects got %v", err)
+	}
+	if _, err := n.WriteFile("b.txt.swp"); err != ErrNoPermission {
+		t.Errorf("WriteFile b.txt.swp got %v", err)
+	}
+	if err := n.Rename("a.txt", ".git/a.txt"); err != ErrNoPermission {
+		t.Errorf("Rename into .git got %v", err)
+	}
+
+	if _, err := Hide(n, "[x"); err == nil {
+		t.Error("Hide accepted a bad pattern")
+	}
+}
+
+func TestMountFileOptions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mount")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, ".hidden"), nil, 0644)
+	ioutil.WriteFile(filepath.Join(dir, "Thumbs.db"), nil, 0644)
+	ioutil.WriteFile(filepath.Join(dir, "shown"), nil, 0644)
+
+	mountfile := filepath.Join(dir, ".mounts")
+	os.Symlink(filepath.Join(dir, "shown"), filepath.Join(dir, "link"))
+	ioutil.WriteFile(mountfile, []byte("/plain:"+dir+"\n/filtered:"+dir+":hide=.*,hidere=^Thumbs\\.db$,symlinks=hide\n/bad:"+dir+":hidere=[\n/mem::memory:\n/drive:C:\\data\n"), 0644)
+
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+	tree, err := NewNodeTreeFromFile(mountfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(logs.Bytes(), []byte("line 3: bad options")) || bytes.Count(logs.Bytes(), []byte("bad options")) != 1 {
+		t.Errorf("bad options logged wrong: %s", logs.Bytes())
+	}
+	if err := tree.MakeDirectory("/mem/d"); err != nil {
+		t.Errorf("MakeDirectory on the memory folder got %v", err)
+	}
+	if files, _ := tree.List("/plain"); len(files) != 5 {
+		t.Errorf("got %d files without options, want 5", len(files))
+	}
+	if files, _ := tree.List("/filtered"); len(files) != 1 || files[0].Name != "shown" {
+		t.Errorf("got %v with hide options", files)
+	}
+}
@@ -0,0 +1,20 @@
+package mount
+
+import "time"
+
+// NodeSetModTime is an optional interface for a Node to change the
+// modification time of files.
+type NodeSetModTime interface {
+	// SetModTime sets the last modification time of the file
+	// under this directory.
+	SetModTime(file string, t time.Time) error
+}
+
+// SetModTime sets the modification time of the file on n, returning
+// ErrNotSupported if n does not implement NodeSetModTime.
+func SetModTime(n Node, file string, t time.Time) error {
+	if nm, ok := n.(NodeSetModTime); ok {
+		return nm.SetModTime(file, t)
+	}
+	return ErrNotSupported
+}
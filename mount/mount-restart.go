@@ -0,0 +1,80 @@
+package mount
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+)
+
+// ErrInvalidOffset is returned when restarting a transfer beyond the end of the file.
+var ErrInvalidOffset = errors.New("restart offset beyond end of file")
+
+// NodeWriteAt is an optional interface for a Node to restart uploads
+// in the middle of a file.
+type NodeWriteAt interface {
+	// WriteFileAt returns a io.Writer that stores the file under
+	// this directory starting at offset, keeping the first offset
+	// bytes of the existing file and discarding the rest.
+	//
+	// If the returned Writer satifies io.Closer, the file is
+	// closed after use.
+	WriteFileAt(file string, offset int64) (io.Writer, error)
+}
+
+// ReadFileAt opens the file on n for reading, starting at offset.
+//
+// The reader is seeked if it implements io.Seeker, and the leading
+// bytes are read and discarded otherwise.
+func ReadFileAt(n Node, file string, offset int64) (io.Reader, error) {
+	r, err := n.ReadFile(file)
+	if err != nil || offset == 0 {
+		return r, err
+	}
+
+	if seeker, ok := r.(io.Seeker); ok {
+		var size int64
+		size, err = seeker.Seek(0, io.SeekEnd)
+		if err == nil && offset > size {
+			err = ErrInvalidOffset
+		}
+		if err == nil {
+			_, err = seeker.Seek(offset, io.SeekStart)
+		}
+	} else {
+		var skipped int64
+		skipped, err = io.CopyN(ioutil.Discard, r, offset)
+		if err == io.EOF && skipped < offset {
+			err = ErrInvalidOffset
+		}
+	}
+
+	if err != nil {
+		if closer, ok := r.(io.Closer); ok {
+			closer.Close()
+		}
+		return nil, err
+	}
+	return r, nil
+}
+
+// WriteFileAt opens the file on n for writing, starting at offset.
+//
+// If n does not implement NodeWriteAt, it is only possible to restart at
+// the end of the existing file, which is done by AppendFile.
+func WriteFileAt(n Node, file string, offset int64) (io.Writer, error) {
+	if offset == 0 {
+		return n.WriteFile(file)
+	}
+	if nw, ok := n.(NodeWriteAt); ok {
+		return nw.WriteFileAt(file, offset)
+	}
+
+	stat, err := n.Stat(file)
+	if err != nil {
+		return nil, err
+	}
+	if stat.Size != offset {
+		return nil, ErrInvalidOffset
+	}
+	return n.AppendFile(file)
+}
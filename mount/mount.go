@@ -15,6 +15,23 @@ type File struct {
 	Size        int64
 	LastModify  time.Time
 	IsDirectory bool // True for a directory, false for a file
+
+	// Optional facts, left zero if unknown to the Node.
+	Create    time.Time   // Creation time
+	Mode      os.FileMode // Unix permission bits
+	Links     int         // Number of hard links
+	Owner     string      // Owner user, name or ID
+	Group     string      // Owner group, name or ID
+	Unique    string      // Identifies the file on the Node, same for links to it
+	MediaType string      // MIME media type, e.g. "text/plain"
+
+	// LinkTarget is the target of a symbolic link listed as a link
+	// instead of the file it points to, empty if not one.
+	LinkTarget string
+
+	// Access limits what can be done to the file whatever the access
+	// level of the user, as on a read-only mount. Zero if not limited.
+	Access Access
 }
 
 var (
@@ -22,6 +39,8 @@ var (
 	ErrFileFound    = os.ErrExist
 	ErrNoPermission = os.ErrPermission
 	ErrNotFolder    = errors.New("listing a non-folder")
+	ErrNotSupported = errors.New("operation not supported")
+	ErrCrossMount   = errors.New("rename across mounted nodes")
 	ErrOther        = errors.New("unknown error")
 )
 
@@ -69,6 +88,10 @@ type Node interface {
 	// RemoveDirectory deletes a directory at the given location, but
 	// does nothing if the file is not a directory.
 	RemoveDirectory(dir string) error
+
+	// Rename renames (moves) a file or directory under this node,
+	// replacing the destination if it is an existing file.
+	Rename(from, to string) error
 }
 
 type MountErrType int
@@ -216,13 +239,16 @@ func (root *NodeTree) Mount(path string, n Node) error {
 
 // NodeTree (should) satsify Node
 var _ Node = &NodeTree{}
+var _ NodeWriteAt = &NodeTree{}
+var _ NodeCreateFile = &NodeTree{}
+var _ NodeSetModTime = &NodeTree{}
 
 func (*NodeTree) Name() string {
 	return "nodetree"
 }
 
 func (n *NodeTree) List(folder string) (files []File, err error) {
-	if folder[0] != '/' {
+	if len(folder) == 0 || folder[0] != '/' {
 		folder = "/" + folder
 	}
 	if folder[len(folder)-1] != '/' {
@@ -230,6 +256,9 @@ func (n *NodeTree) List(folder string) (files []File, err error) {
 	}
 
 	node := n.walk(folder)
+	if node == nil {
+		return nil, ErrFileNotFound
+	}
 
 	if node.node != nil {
 		return node.node.List(folder[len(node.completePath):])
@@ -304,6 +333,24 @@ func (n *NodeTree) AppendFile(file string) (io.Writer, error) {
 	rawNodePath := stripSlash(node.completePath)
 	return node.node.AppendFile(file[len(rawNodePath):])
 }
+func (n *NodeTree) WriteFileAt(file string, offset int64) (io.Writer, error) {
+	file = stripSlash(file)
+	node := n.walk(file)
+	if node == nil || node.node == nil {
+		return nil, ErrFileNotFound
+	}
+	rawNodePath := stripSlash(node.completePath)
+	return WriteFileAt(node.node, file[len(rawNodePath):], offset)
+}
+func (n *NodeTree) CreateFile(file string) (io.Writer, error) {
+	file = stripSlash(file)
+	node := n.walk(file)
+	if node == nil || node.node == nil {
+		return nil, ErrFileNotFound
+	}
+	rawNodePath := stripSlash(node.completePath)
+	return CreateFile(node.node, file[len(rawNodePath):])
+}
 func (n *NodeTree) DeleteFile(file string) error {
 	file = stripSlash(file)
 	node := n.walk(file)
@@ -331,3 +378,31 @@ func (n *NodeTree) RemoveDirectory(dir string) error {
 	rawNodePath := stripSlash(node.completePath)
 	return node.node.RemoveDirectory(dir[len(rawNodePath):])
 }
+
+func (n *NodeTree) SetModTime(file string, t time.Time) error {
+	file = stripSlash(file)
+	node := n.walk(file)
+	if node == nil || node.node == nil {
+		return ErrFileNotFound
+	}
+	rawNodePath := stripSlash(node.completePath)
+	return SetModTime(node.node, file[len(rawNodePath):], t)
+}
+
+// Rename renames a file inside a mounted node. Renaming across different
+// mounted nodes fails with ErrCrossMount.
+func (n *NodeTree) Rename(from, to string) error {
+	from, to = stripSlash(from), stripSlash(to)
+	fromNode, toNode := n.walk(from), n.walk(to)
+	if fromNode == nil || fromNode.node == nil {
+		return ErrFileNotFound
+	}
+	if toNode == nil || toNode.node == nil {
+		return ErrNoPermission
+	}
+	if fromNode != toNode {
+		return ErrCrossMount
+	}
+	rawNodePath := stripSlash(fromNode.completePath)
+	return fromNode.node.Rename(from[len(rawNodePath):], to[len(rawNodePath):])
+}
@@ -10,7 +10,7 @@ func TestMount(t *testing.T) {
 
 	n := &NodeSysFolder{NodeName: "Test", Path: "./"}
 
-	root := NewRootNode()
+	root := NewNodeTree()
 
 	root.Mount("/213/4325/gfd/", n)
 	root.Mount("/213/4325/dfs/", n)
@@ -43,6 +43,9 @@ func TestMount(t *testing.T) {
 		t.Errorf("Filesystem mount List failed: %s", err.Error())
 	}
 	fmt.Print(files)
+	if _, err := root.List("/nope"); err != ErrFileNotFound {
+		t.Errorf("List on a missing folder got %v", err)
+	}
 
 	stat, err := root.Stat("/root/mount_test.go")
 	if err != nil {
@@ -0,0 +1,380 @@
+package mount
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrNoSpace is returned when a write exceeds the size limits of a Node.
+var ErrNoSpace = errors.New("not enough space")
+
+// ErrNotEmpty is returned when removing a folder that is not empty.
+var ErrNotEmpty = errors.New("folder not empty")
+
+// NodeMemory is a virtual filesystem node keeping its folders and files in
+// memory, which are lost when the program exits.
+//
+// The zero value is an empty folder ready to use. It must not be copied
+// after first use.
+type NodeMemory struct {
+	// NodeName is the name of the node in the mount.
+	NodeName string
+	// MaxSize limits the total size of the files in bytes, 0 for no limit.
+	MaxSize int64
+	// MaxFileSize limits the size of a single file in bytes, 0 for no limit.
+	MaxFileSize int64
+
+	lock sync.Mutex
+	root *memEntry
+	size int64 // Total size of the files
+}
+
+var _ Node = &NodeMemory{}
+var _ NodeWriteAt = &NodeMemory{}
+var _ NodeCreateFile = &NodeMemory{}
+var _ NodeSetModTime = &NodeMemory{}
+
+// memEntry is a file or folder in a NodeMemory.
+type memEntry struct {
+	name     string
+	dir      bool
+	data     []byte // File content, only appended to in place
+	modify   time.Time
+	create   time.Time
+	children map[string]*memEntry // Folder content
+
+	removed bool // Deleted or replaced, no longer in the tree
+}
+
+func (e *memEntry) file() File {
+	return File{
+		Name:        e.name,
+		Size:        int64(len(e.data)),
+		LastModify:  e.modify,
+		IsDirectory: e.dir,
+		Create:      e.create,
+	}
+}
+
+func (n *NodeMemory) Name() string { return "memory:" + n.NodeName }
+
+// splitPath returns the folder and the name of a file, cleaned.
+func splitPath(file string) (dir, name string) {
+	file = path.Clean("/" + file)
+	return path.Dir(file), path.Base(file)
+}
+
+// lookup returns the entry at file, or nil if not found.
+//
+// n.lock must be held.
+func (n *NodeMemory) lookup(file string) *memEntry {
+	if n.root == nil {
+		now := time.Now()
+		n.root = &memEntry{name: "/", dir: true, modify: now, create: now}
+	}
+
+	cur := n.root
+	for _, name := range strings.Split(path.Clean("/"+file), "/") {
+		if len(name) == 0 {
+			continue
+		}
+		if !cur.dir {
+			return nil
+		}
+		if cur = cur.children[name]; cur == nil {
+			return nil
+		}
+	}
+	return cur
+}
+
+// remove removes the entry name from the folder dir, and all the files
+// under it from the total size.
+//
+// n.lock must be held.
+func (n *NodeMemory) remove(dir *memEntry, name string) {
+	var walk func(e *memEntry)
+	walk = func(e *memEntry) {
+		e.removed = true
+		n.size -= int64(len(e.data))
+		for _, c := range e.children {
+			walk(c)
+		}
+	}
+	if e := dir.children[name]; e != nil {
+		walk(e)
+		delete(dir.children, name)
+	}
+}
+
+func (n *NodeMemory) List(folder string) ([]File, error) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	e := n.lookup(folder)
+	if e == nil {
+		return nil, ErrFileNotFound
+	}
+	if !e.dir {
+		return nil, ErrNotFolder
+	}
+
+	files := make([]File, 0, len(e.children))
+	for _, c := range e.children {
+		files = append(files, c.file())
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Name < files[j].Name })
+	return files, nil
+}
+
+func (n *NodeMemory) Stat(file string) (File, error) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	e := n.lookup(file)
+	if e == nil {
+		return File{}, ErrFileNotFound
+	}
+	return e.file(), nil
+}
+
+func (n *NodeMemory) ReadFile(file string) (io.Reader, error) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	e := n.lookup(file)
+	if e == nil {
+		return nil, ErrFileNotFound
+	}
+	if e.dir {
+		return nil, ErrNoPermission
+	}
+	// Bytes before len(e.data) are never changed, only replaced
+	return bytes.NewReader(e.data), nil
+}
+
+// open opens the file for writing, keeping the first keep bytes of an
+// existing one, or failing with ErrFileFound if exclusive.
+func (n *NodeMemory) open(file string, keep int64, exclusive bool) (io.Writer, error) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	dirname, name := splitPath(file)
+	dir := n.lookup(dirname)
+	if dir == nil || name == "/" {
+		return nil, ErrFileNotFound
+	}
+	if !dir.dir {
+		return nil, ErrNotFolder
+	}
+
+	e := dir.children[name]
+	switch {
+	case e != nil && e.dir:
+		return nil, ErrNoPermission
+	case e != nil && exclusive:
+		return nil, ErrFileFound
+	case e != nil && keep > int64(len(e.data)):
+		return nil, ErrInvalidOffset
+	case e == nil && keep > 0:
+		return nil, ErrInvalidOffset
+	}
+
+	if e == nil {
+		e = &memEntry{name: name, create: time.Now()}
+		if dir.children == nil {
+			dir.children = make(map[string]*memEntry)
+		}
+		dir.children[name] = e
+		dir.modify = time.Now()
+	} else if keep < int64(len(e.data)) {
+		// Readers might still be reading the old content
+		n.size -= int64(len(e.data)) - keep
+		e.data = append([]byte(nil), e.data[:keep]...)
+	}
+	e.modify = time.Now()
+	return &memWriter{n: n, e: e}, nil
+}
+
+func (n *NodeMemory) WriteFile(file string) (io.Writer, error) {
+	return n.open(file, 0, false)
+}
+
+func (n *NodeMemory) WriteFileAt(file string, offset int64) (io.Writer, error) {
+	return n.open(file, offset, false)
+}
+
+func (n *NodeMemory) CreateFile(file string) (io.Writer, error) {
+	return n.open(file, 0, true)
+}
+
+func (n *NodeMemory) AppendFile(file string) (io.Writer, error) {
+	n.lock.Lock()
+	e := n.lookup(file)
+	var size int64
+	if e != nil {
+		size = int64(len(e.data))
+	}
+	n.lock.Unlock()
+
+	w, err := n.open(file, size, false)
+	if err == ErrInvalidOffset { // Changed in between
+		return n.AppendFile(file)
+	}
+	return w, err
+}
+
+// memWriter appends to a file of a NodeMemory.
+type memWriter struct {
+	n *NodeMemory
+	e *memEntry
+}
+
+func (w *memWriter) Write(p []byte) (int, error) {
+	n, e := w.n, w.e
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	if e.removed { // Deleted while writing, discard it
+		return len(p), nil
+	}
+	if n.MaxFileSize > 0 && int64(len(e.data)+len(p)) > n.MaxFileSize {
+		return 0, ErrNoSpace
+	}
+	if n.MaxSize > 0 && n.size+int64(len(p)) > n.MaxSize {
+		return 0, ErrNoSpace
+	}
+
+	e.data = append(e.data, p...)
+	e.modify = time.Now()
+	n.size += int64(len(p))
+	return len(p), nil
+}
+
+func (n *NodeMemory) DeleteFile(file string) error {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	dirname, name := splitPath(file)
+	dir := n.lookup(dirname)
+	if dir == nil || !dir.dir || dir.children[name] == nil {
+		return ErrFileNotFound
+	}
+	if dir.children[name].dir {
+		return ErrNoPermission
+	}
+	n.remove(dir, name)
+	dir.modify = time.Now()
+	return nil
+}
+
+// MakeDirectory creates the folder, along with any parents missing.
+func (n *NodeMemory) MakeDirectory(dir string) error {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	cur := n.lookup("")
+	for _, name := range strings.Split(path.Clean("/"+dir), "/") {
+		if len(name) == 0 {
+			continue
+		}
+		next := cur.children[name]
+		if next == nil {
+			now := time.Now()
+			next = &memEntry{name: name, dir: true, modify: now, create: now}
+			if cur.children == nil {
+				cur.children = make(map[string]*memEntry)
+			}
+			cur.children[name] = next
+			cur.modify = time.Now()
+		} else if !next.dir {
+			return ErrFileFound
+		}
+		cur = next
+	}
+	return nil
+}
+
+func (n *NodeMemory) RemoveDirectory(dir string) error {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	parentname, name := splitPath(dir)
+	parent := n.lookup(parentname)
+	if name == "/" {
+		return ErrNoPermission
+	}
+	if parent == nil || !parent.dir || parent.children[name] == nil {
+		return ErrFileNotFound
+	}
+	e := parent.children[name]
+	if !e.dir {
+		return ErrNotFolder
+	}
+	if len(e.children) != 0 {
+		return ErrNotEmpty
+	}
+	n.remove(parent, name)
+	parent.modify = time.Now()
+	return nil
+}
+
+func (n *NodeMemory) Rename(from, to string) error {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	fromdir, fromname := splitPath(from)
+	todir, toname := splitPath(to)
+	src, dst := n.lookup(fromdir), n.lookup(todir)
+	if fromname == "/" || toname == "/" {
+		return ErrNoPermission
+	}
+	if src == nil || !src.dir || src.children[fromname] == nil {
+		return ErrFileNotFound
+	}
+	if dst == nil || !dst.dir {
+		return ErrFileNotFound
+	}
+
+	e := src.children[fromname]
+	from, to = path.Clean("/"+from), path.Clean("/"+to)
+	if e.dir && from != to && strings.HasPrefix(to+"/", from+"/") {
+		return ErrNoPermission // Into itself
+	}
+	if old := dst.children[toname]; old != nil {
+		if old == e {
+			return nil
+		}
+		if old.dir {
+			return ErrFileFound
+		}
+		n.remove(dst, toname)
+	}
+
+	delete(src.children, fromname)
+	e.name = toname
+	if dst.children == nil {
+		dst.children = make(map[string]*memEntry)
+	}
+	dst.children[toname] = e
+	src.modify, dst.modify = time.Now(), time.Now()
+	return nil
+}
+
+func (n *NodeMemory) SetModTime(file string, t time.Time) error {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	e := n.lookup(file)
+	if e == nil {
+		return ErrFileNotFound
+	}
+	e.modify = t
+	return nil
+}
@@ -0,0 +1,194 @@
+package mount
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func readAll(t *testing.T, n Node, file string) string {
+	r, err := n.ReadFile(file)
+	if err != nil {
+		t.Fatalf("ReadFile(%q): %v", file, err)
+	}
+	data, _ := ioutil.ReadAll(r)
+	return string(data)
+}
+
+func TestNodeMemory(t *testing.T) {
+	n := &NodeMemory{}
+
+	if err := n.MakeDirectory("a/b"); err != nil {
+		t.Fatal(err)
+	}
+	w, err := n.WriteFile("a/b/f.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(w, "hello")
+
+	// Readers keep what they opened
+	r, _ := n.ReadFile("a/b/f.txt")
+	w, _ = WriteFileAt(n, "a/b/f.txt", 2)
+	io.WriteString(w, "y!")
+	if data, _ := ioutil.ReadAll(r); string(data) != "hello" {
+		t.Errorf("old reader got %q", data)
+	}
+	if got := readAll(t, n, "/a/b/f.txt"); got != "hey!" {
+		t.Errorf("got %q after WriteFileAt", got)
+	}
+	if _, err := WriteFileAt(n, "a/b/f.txt", 5); err != ErrInvalidOffset {
+		t.Errorf("WriteFileAt past the end got %v", err)
+	}
+
+	w, _ = n.AppendFile("a/b/f.txt")
+	io.WriteString(w, "!")
+	if stat, err := n.Stat("a/b/f.txt"); err != nil || stat.Size != 5 || stat.IsDirectory || stat.Create.IsZero() {
+		t.Errorf("Stat got %+v, %v", stat, err)
+	}
+	if _, err := CreateFile(n, "a/b/f.txt"); err != ErrFileFound {
+		t.Errorf("CreateFile on existing file got %v", err)
+	}
+
+	modify := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	n.SetModTime("a", modify)
+	if files, err := n.List("/"); err != nil || len(files) != 1 || !files[0].IsDirectory || !files[0].LastModify.Equal(modify) {
+		t.Errorf("List got %v, %v", files, err)
+	}
+	if _, err := n.List("a/b/f.txt"); err != ErrNotFolder {
+		t.Errorf("List on a file got %v", err)
+	}
+	if _, err := n.WriteFile("a/b/f.txt/x"); err != ErrNotFolder {
+		t.Errorf("WriteFile under a file got %v", err)
+	}
+
+	if err := n.Rename("a", "a/b/c"); err != ErrNoPermission {
+		t.Errorf("Rename into itself got %v", err)
+	}
+	if err := n.Rename("a/b", "c"); err != nil {
+		t.Fatal(err)
+	}
+	if got := readAll(t, n, "c/f.txt"); got != "hey!!" {
+		t.Errorf("got %q after Rename", got)
+	}
+	if err := n.RemoveDirectory("c"); err != ErrNotEmpty {
+		t.Errorf("RemoveDirectory on non-empty folder got %v", err)
+	}
+	if err := n.DeleteFile("c/f.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if err := n.RemoveDirectory("c"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := n.Stat("c"); err != ErrFileNotFound {
+		t.Errorf("Stat after RemoveDirectory got %v", err)
+	}
+}
+
+func TestNodeMemoryLimits(t *testing.T) {
+	n := &NodeMemory{MaxSize: 10, MaxFileSize: 6}
+
+	w, _ := n.WriteFile("a")
+	if _, err := io.WriteString(w, "1234567"); err != ErrNoSpace {
+		t.Errorf("writing past MaxFileSize got %v", err)
+	}
+	io.WriteString(w, "123456")
+	w, _ = n.WriteFile("b")
+	if _, err := io.WriteString(w, "12345"); err != ErrNoSpace {
+		t.Errorf("writing past MaxSize got %v", err)
+	}
+
+	// Space is freed by deleting and truncating
+	n.DeleteFile("a")
+	io.WriteString(w, "12345")
+	w, _ = n.WriteFile("b")
+	if _, err := io.WriteString(w, "123456"); err != nil {
+		t.Errorf("writing after truncating got %v", err)
+	}
+	if n.size != 6 {
+		t.Errorf("got total size %d, want 6", n.size)
+	}
+}
+
+func TestNodeMemoryConcurrent(t *testing.T) {
+	n := &NodeMemory{}
+	n.MakeDirectory("d")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			file := fmt.Sprintf("d/%d", i)
+			for j := 0; j < 100; j++ {
+				w, _ := n.WriteFile(file)
+				io.WriteString(w, "data")
+				if r, err := n.ReadFile(file); err == nil {
+					ioutil.ReadAll(r)
+				}
+				w, _ = n.AppendFile(file)
+				io.WriteString(w, "more")
+				n.List("d")
+				n.Rename(file, file+".tmp")
+				n.Rename(file+".tmp", file)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	files, _ := n.List("d")
+	if len(files) != 8 {
+		t.Fatalf("got %d files, want 8", len(files))
+	}
+	for _, f := range files {
+		if f.Size != 8 {
+			t.Errorf("got %+v, want size 8", f)
+		}
+	}
+}
+
+func TestMountFileMemory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mount")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	mountfile := filepath.Join(dir, ".mounts")
+	ioutil.WriteFile(mountfile, []byte("/tmp::memory:\n/small::memory::maxsize=1K,hide=.*\n"), 0644)
+
+	tree, err := NewNodeTreeFromFile(mountfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := tree.WriteFile("/tmp/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(w, "hello")
+	if files, _ := tree.List("/tmp"); len(files) != 1 || files[0].Size != 5 {
+		t.Errorf("got %v on /tmp", files)
+	}
+
+	w, _ = tree.WriteFile("/small/b")
+	if _, err := w.Write(make([]byte, 1025)); err != ErrNoSpace {
+		t.Errorf("writing past maxsize got %v", err)
+	}
+	if _, err := tree.WriteFile("/small/.c"); err != ErrNoPermission {
+		t.Errorf("writing a hidden file got %v", err)
+	}
+
+	if size, err := parseSize("64M"); err != nil || size != 64<<20 {
+		t.Errorf("parseSize(64M) got %d, %v", size, err)
+	}
+	for _, s := range []string{"", "K", "-1", "1T", "99999999999G"} {
+		if _, err := parseSize(s); err == nil {
+			t.Errorf("parseSize(%q) succeeded", s)
+		}
+	}
+}
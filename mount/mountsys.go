@@ -4,7 +4,11 @@ import (
 	"io"
 	"io/ioutil"
 	"os"
+	"path"
 	"path/filepath"
+	"strings"
+	"time"
+	"unicode/utf8"
 )
 
 // NodeSysFolder is a virtual filesystem node mounted from
@@ -15,65 +19,357 @@ type NodeSysFolder struct {
 	// NodeName is the name of the folder in the mount. It is not reflected
 	// in the virtual filesystem.
 	NodeName string
+	// Symlinks is the policy on symbolic links, defaults to
+	// SymlinkFollowWithinRoot.
+	Symlinks SymlinkPolicy
 }
 
+// SymlinkPolicy is how a NodeSysFolder treats symbolic links.
+type SymlinkPolicy int
+
+// Symlink policies
+const (
+	// Follow the symlinks resolving to inside of Path, hiding the others.
+	SymlinkFollowWithinRoot SymlinkPolicy = iota
+	// Follow all the symlinks, even those resolving to outside of Path.
+	SymlinkFollow
+	// Hide all the symlinks as if they did not exist.
+	SymlinkHide
+	// List symlinks as links with their targets, while following them
+	// like SymlinkFollowWithinRoot when accessed.
+	SymlinkShowAsLink
+)
+
 var _ Node = &NodeSysFolder{}
+var _ NodeWriteAt = &NodeSysFolder{}
+var _ NodeCreateFile = &NodeSysFolder{}
+var _ NodeSetModTime = &NodeSysFolder{}
 
 func (n *NodeSysFolder) Name() string { return "sysfolder:" + n.NodeName }
 
 func (n *NodeSysFolder) List(folder string) (files []File, err error) {
-	osfiles, err := ioutil.ReadDir(filepath.Join(n.Path, folder))
+	folder, err = n.sysPath(folder)
+	if err != nil {
+		return nil, err
+	}
+	osfiles, err := ioutil.ReadDir(folder)
 	if err != nil {
 		return nil, err
 	}
 
-	files = make([]File, len(osfiles))
-	for i, f := range osfiles {
-		files[i] = File{
-			Name:        f.Name(),
-			Size:        f.Size(),
-			LastModify:  f.ModTime(),
-			IsDirectory: f.IsDir(),
+	files = make([]File, 0, len(osfiles))
+	for _, f := range osfiles {
+		if f.Mode()&os.ModeSymlink == 0 {
+			files = append(files, sysFile(f))
+		} else if file, ok := n.symlinkFile(filepath.Join(folder, f.Name()), f); ok {
+			files = append(files, file)
 		}
 	}
 
 	return
 }
 
+// symlinkFile returns the File listed for the symlink sys by the symlink
+// policy, or false if it is hidden.
+func (n *NodeSysFolder) symlinkFile(sys string, info os.FileInfo) (File, bool) {
+	switch n.Symlinks {
+	case SymlinkHide:
+		return File{}, false
+	case SymlinkShowAsLink:
+		target, err := os.Readlink(sys)
+		if err != nil {
+			return File{}, false
+		}
+		f := sysFile(info)
+		f.LinkTarget = target
+		return f, true
+	case SymlinkFollowWithinRoot:
+		root, err := filepath.EvalSymlinks(n.Path)
+		if err != nil {
+			return File{}, false
+		}
+		if real, err := filepath.EvalSymlinks(sys); err != nil || !insidePath(root, real) {
+			return File{}, false
+		}
+	}
+
+	// Listed as the target, hiding dangling ones
+	stat, err := os.Stat(sys)
+	if err != nil {
+		return File{}, false
+	}
+	return sysFile(stat), true
+}
+
 func (n *NodeSysFolder) Stat(file string) (result File, err error) {
-	stat, err := os.Stat(filepath.Join(n.Path, file))
+	file, err = n.sysPath(file)
+	if err != nil {
+		return File{}, err
+	}
+	stat, err := os.Stat(file)
 	if err != nil {
 		return File{}, err
 	}
 
-	return File{
-		Name:        stat.Name(),
-		Size:        stat.Size(),
-		LastModify:  stat.ModTime(),
-		IsDirectory: stat.IsDir(),
-	}, nil
+	return sysFile(stat), nil
+}
+
+// sysFile returns the File for a system file.
+func sysFile(info os.FileInfo) File {
+	f := File{
+		Name:        info.Name(),
+		Size:        info.Size(),
+		LastModify:  info.ModTime(),
+		IsDirectory: info.IsDir(),
+		Mode:        info.Mode().Perm(),
+		Create:      sysFileCreate(info),
+	}
+	sysFileOwner(info, &f)
+	return f
 }
 
 func (n *NodeSysFolder) ReadFile(file string) (io.Reader, error) {
-	return os.Open(filepath.Join(n.Path, file))
+	file, err := n.sysPath(file)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(file)
 }
 
 func (n *NodeSysFolder) WriteFile(file string) (io.Writer, error) {
-	return os.Create(filepath.Join(n.Path, file))
+	file, err := n.sysPath(file)
+	if err != nil {
+		return nil, err
+	}
+	return os.Create(file)
+}
+
+func (n *NodeSysFolder) CreateFile(file string) (io.Writer, error) {
+	file, err := n.sysPath(file)
+	if err != nil {
+		return nil, err
+	}
+	return os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
 }
 
 func (n *NodeSysFolder) AppendFile(file string) (io.Writer, error) {
-	return os.OpenFile(filepath.Join(n.Path, file), os.O_RDWR|os.O_APPEND|os.O_CREATE, 0)
+	file, err := n.sysPath(file)
+	if err != nil {
+		return nil, err
+	}
+	return os.OpenFile(file, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0)
+}
+
+func (n *NodeSysFolder) WriteFileAt(file string, offset int64) (io.Writer, error) {
+	file, err := n.sysPath(file)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, err
+	}
+
+	stat, err := f.Stat()
+	if err == nil && offset > stat.Size() {
+		err = ErrInvalidOffset
+	}
+	if err == nil {
+		err = f.Truncate(offset)
+	}
+	if err == nil {
+		_, err = f.Seek(offset, io.SeekStart)
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
 }
 
 func (n *NodeSysFolder) DeleteFile(file string) error {
-	return os.Remove(filepath.Join(n.Path, file))
+	file, err := n.sysPathNotRoot(file)
+	if err != nil {
+		return err
+	}
+	return os.Remove(file)
 }
 
 func (n *NodeSysFolder) MakeDirectory(dir string) error {
-	return os.MkdirAll(filepath.Join(n.Path, dir), 0)
+	dir, err := n.sysPath(dir)
+	if err != nil {
+		return err
+	}
+	return os.MkdirAll(dir, 0)
 }
 
 func (n *NodeSysFolder) RemoveDirectory(dir string) error {
-	return os.Remove(filepath.Join(n.Path))
+	dir, err := n.sysPathNotRoot(dir)
+	if err != nil {
+		return err
+	}
+	return os.Remove(dir)
+}
+
+func (n *NodeSysFolder) Rename(from, to string) error {
+	from, err := n.sysPathNotRoot(from)
+	if err != nil {
+		return err
+	}
+	to, err = n.sysPathNotRoot(to)
+	if err != nil {
+		return err
+	}
+	return os.Rename(from, to)
+}
+
+func (n *NodeSysFolder) SetModTime(file string, t time.Time) error {
+	file, err := n.sysPath(file)
+	if err != nil {
+		return err
+	}
+	return os.Chtimes(file, t, t)
+}
+
+// sysPath returns the system path of a file under the folder.
+//
+// It is guaranteed to be inside Path: ".." elements never go above it.
+// Unless the symlink policy is SymlinkFollow, ErrNoPermission is returned
+// if any existing part of the path is a symlink resolving to outside of
+// Path, dangling or not, or ErrFileNotFound if it is a symlink at all with
+// SymlinkHide.
+func (n *NodeSysFolder) sysPath(file string) (string, error) {
+	sys := filepath.Join(n.Path, filepath.FromSlash(path.Clean("/"+file)))
+
+	switch n.Symlinks {
+	case SymlinkFollow:
+		return sys, nil
+	case SymlinkHide:
+		if throughSymlink(n.Path, sys) {
+			return "", ErrFileNotFound
+		}
+		return sys, nil
+	}
+
+	root, err := filepath.EvalSymlinks(n.Path)
+	if err == nil {
+		root, err = filepath.Abs(root)
+	}
+	if err != nil {
+		return "", err
+	}
+	abs, err := filepath.Abs(sys)
+	if err != nil {
+		return "", err
+	}
+
+	real, err := realPath(abs)
+	if err != nil {
+		return "", err
+	}
+	if !insidePath(root, real) {
+		return "", ErrNoPermission
+	}
+	return sys, nil
+}
+
+// Maximum number of symlinks followed in resolving a path, against loops.
+const maxSymlinks = 255
+
+// realPath resolves the symlinks in the absolute system path file the way
+// the system does when opening or creating it, following dangling ones to
+// where they would create the file. The elements from the first one that
+// does not exist are kept as is, as nothing can be opened below it.
+func realPath(file string) (string, error) {
+	vol := filepath.VolumeName(file)
+	cur := vol + string(filepath.Separator)
+	todo := pathElems(file[len(vol):])
+
+	for links := 0; len(todo) != 0; {
+		elem := todo[0]
+		todo = todo[1:]
+		switch elem {
+		case ".":
+			continue
+		case "..":
+			cur = filepath.Dir(cur) // cur has no symlinks, so this is right
+			continue
+		}
+
+		next := filepath.Join(cur, elem)
+		info, err := os.Lstat(next)
+		if os.IsNotExist(err) {
+			return filepath.Join(append([]string{next}, todo...)...), nil
+		}
+		if err != nil {
+			return "", err
+		}
+		if info.Mode()&os.ModeSymlink == 0 {
+			cur = next
+			continue
+		}
+
+		if links++; links > maxSymlinks {
+			return "", ErrNoPermission
+		}
+		target, err := os.Readlink(next)
+		if err != nil {
+			return "", err
+		}
+		if tvol := filepath.VolumeName(target); len(target) > len(tvol) && os.IsPathSeparator(target[len(tvol)]) {
+			// From the root, of the same volume if not given
+			if len(tvol) == 0 {
+				tvol = filepath.VolumeName(cur)
+			}
+			cur, target = tvol+string(filepath.Separator), target[len(filepath.VolumeName(target)):]
+		}
+		todo = append(pathElems(target), todo...)
+	}
+	return cur, nil
+}
+
+// pathElems splits a system path into its elements, without empty ones.
+func pathElems(file string) []string {
+	return strings.FieldsFunc(file, func(r rune) bool {
+		return r < utf8.RuneSelf && os.IsPathSeparator(uint8(r))
+	})
+}
+
+// throughSymlink reports if any existing part of the system path file
+// under root is a symlink.
+func throughSymlink(root, file string) bool {
+	rel, err := filepath.Rel(root, file)
+	if err != nil || rel == "." {
+		return false
+	}
+	cur := root
+	for _, elem := range strings.Split(rel, string(filepath.Separator)) {
+		cur = filepath.Join(cur, elem)
+		stat, err := os.Lstat(cur)
+		if err != nil {
+			return false
+		}
+		if stat.Mode()&os.ModeSymlink != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// sysPathNotRoot is like sysPath, but returns ErrNoPermission for Path
+// itself, which must not be deleted or renamed.
+func (n *NodeSysFolder) sysPathNotRoot(file string) (string, error) {
+	if path.Clean("/"+file) == "/" {
+		return "", ErrNoPermission
+	}
+	return n.sysPath(file)
+}
+
+// insidePath reports if the system path file is root or inside it.
+func insidePath(root, file string) bool {
+	rel, err := filepath.Rel(root, file)
+	if err != nil {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
 }
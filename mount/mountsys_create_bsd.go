@@ -0,0 +1,19 @@
+//go:build darwin || freebsd || netbsd
+// +build darwin freebsd netbsd
+
+package mount
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+// sysFileCreate returns the creation time of a system file.
+func sysFileCreate(info os.FileInfo) time.Time {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return time.Time{}
+	}
+	return time.Unix(st.Birthtimespec.Unix())
+}
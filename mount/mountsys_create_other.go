@@ -0,0 +1,13 @@
+//go:build !darwin && !freebsd && !netbsd && !windows
+// +build !darwin,!freebsd,!netbsd,!windows
+
+package mount
+
+import (
+	"os"
+	"time"
+)
+
+// sysFileCreate returns the creation time of a system file, which is not
+// available on this system.
+func sysFileCreate(info os.FileInfo) time.Time { return time.Time{} }
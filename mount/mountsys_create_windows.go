@@ -0,0 +1,16 @@
+package mount
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+// sysFileCreate returns the creation time of a system file.
+func sysFileCreate(info os.FileInfo) time.Time {
+	attr, ok := info.Sys().(*syscall.Win32FileAttributeData)
+	if !ok {
+		return time.Time{}
+	}
+	return time.Unix(0, attr.CreationTime.Nanoseconds())
+}
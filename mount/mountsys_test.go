@@ -0,0 +1,177 @@
+package mount
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// sandboxFolder creates a NodeSysFolder, along with a folder outside of
+// it, and symlinks to both.
+func sandboxFolder(t testing.TB) (n *NodeSysFolder, outside string) {
+	dir, err := ioutil.TempDir("", "mount")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cl, ok := t.(interface{ Cleanup(func()) }); ok {
+		cl.Cleanup(func() { os.RemoveAll(dir) })
+	}
+
+	root, outside := filepath.Join(dir, "root"), filepath.Join(dir, "outside")
+	os.MkdirAll(filepath.Join(root, "a", "b"), 0755)
+	os.MkdirAll(outside, 0755)
+	ioutil.WriteFile(filepath.Join(root, "a", "file"), []byte("inside"), 0644)
+	ioutil.WriteFile(filepath.Join(outside, "secret"), []byte("outside"), 0644)
+	os.Symlink(outside, filepath.Join(root, "out"))
+	os.Symlink("../../outside", filepath.Join(root, "a", "rel"))
+	os.Symlink(filepath.Join(root, "a"), filepath.Join(root, "in"))
+
+	// Dangling ones, to outside directly or through another, and inside
+	os.Symlink("../outside/created", filepath.Join(root, "dangle"))
+	os.Symlink(filepath.Join(outside, "created2"), filepath.Join(root, "adangle"))
+	os.Symlink("../dangle", filepath.Join(root, "a", "chain"))
+	os.Symlink("a/new", filepath.Join(root, "newlink"))
+	return &NodeSysFolder{Path: root}, outside
+}
+
+// outsideChanged reports if anything but the secret file is in outside.
+func outsideChanged(outside string) bool {
+	files, err := ioutil.ReadDir(outside)
+	return err != nil || len(files) != 1 || files[0].Name() != "secret"
+}
+
+func closeWriter(w io.Writer) {
+	if c, ok := w.(io.Closer); ok {
+		c.Close()
+	}
+}
+
+func TestSysFolderSandbox(t *testing.T) {
+	n, outside := sandboxFolder(t)
+
+	for _, file := range []string{"a/file", "/a/file", "../a/file", "a/b/../../../a/file", "in/file"} {
+		if _, err := n.Stat(file); err != nil {
+			t.Errorf("Stat %s got %v", file, err)
+		}
+	}
+	for _, file := range []string{"out/secret", "out", "a/rel/secret", "in/rel/secret", "../outside/secret", "a/../../outside/secret"} {
+		if _, err := n.ReadFile(file); err == nil {
+			t.Errorf("ReadFile %s succeeded", file)
+		}
+	}
+	if _, err := n.WriteFile("out/new"); err != ErrNoPermission {
+		t.Errorf("WriteFile out/new got %v", err)
+	}
+	if err := n.RemoveDirectory("/"); err != ErrNoPermission {
+		t.Errorf("RemoveDirectory / got %v", err)
+	}
+
+	// Dangling symlinks are checked where they would create the file
+	for _, file := range []string{"dangle", "adangle", "a/chain", "dangle/x"} {
+		if _, err := n.WriteFile(file); err != ErrNoPermission {
+			t.Errorf("WriteFile %s got %v", file, err)
+		}
+		if _, err := n.AppendFile(file); err != ErrNoPermission {
+			t.Errorf("AppendFile %s got %v", file, err)
+		}
+		if _, err := n.WriteFileAt(file, 0); err != ErrNoPermission {
+			t.Errorf("WriteFileAt %s got %v", file, err)
+		}
+		if err := n.MakeDirectory(file); err != ErrNoPermission {
+			t.Errorf("MakeDirectory %s got %v", file, err)
+		}
+	}
+	if outsideChanged(outside) {
+		t.Error("created a file outside")
+	}
+	w, err := n.WriteFile("newlink")
+	if err != nil {
+		t.Errorf("WriteFile newlink got %v", err)
+	} else {
+		closeWriter(w)
+	}
+	if _, err := os.Stat(filepath.Join(n.Path, "a", "new")); err != nil {
+		t.Errorf("WriteFile newlink did not create a/new: %v", err)
+	}
+
+	if err := n.Rename("a/file", "../../moved"); err != nil {
+		t.Errorf("Rename got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(n.Path, "moved")); err != nil {
+		t.Errorf("Renamed file not found: %v", err)
+	}
+}
+
+func FuzzSysFolderPath(f *testing.F) {
+	for _, seed := range []string{"", "/", "..", "a/file", "../../etc/passwd", "a/b/../../..", "//out//secret", "in/../out", "a/rel/secret", "a/./b/./..", "dangle", "a/chain", "in/chain/x"} {
+		f.Add(seed)
+	}
+	n, outside := sandboxFolder(f)
+
+	f.Fuzz(func(t *testing.T, file string) {
+		if sys, err := n.sysPath(file); err == nil && !insidePath(n.Path, sys) {
+			t.Fatalf("%q: %s is not under %s", file, sys, n.Path)
+		}
+
+		// Whatever the path resolves to, nothing is read or created outside
+		if r, err := n.ReadFile(file); err == nil {
+			data, _ := ioutil.ReadAll(r)
+			r.(io.Closer).Close()
+			if string(data) == "outside" {
+				t.Fatalf("%q: read the file outside", file)
+			}
+		}
+		if w, err := n.WriteFile(file); err == nil {
+			closeWriter(w)
+		}
+		n.MakeDirectory(file)
+		if outsideChanged(outside) {
+			t.Fatalf("%q: created a file outside", file)
+		}
+	})
+}
+
+func TestSymlinkPolicy(t *testing.T) {
+	names := func(files []File) string {
+		var s []string
+		for _, f := range files {
+			if len(f.LinkTarget) != 0 {
+				s = append(s, f.Name+"->"+filepath.Base(f.LinkTarget))
+			} else {
+				s = append(s, f.Name)
+			}
+		}
+		sort.Strings(s)
+		return strings.Join(s, ",")
+	}
+
+	tests := []struct {
+		policy         SymlinkPolicy
+		list           string
+		outside, inner bool // Access to out/secret and in/file
+	}{
+		{SymlinkFollowWithinRoot, "a,in", false, true},
+		{SymlinkFollow, "a,in,out", true, true},
+		{SymlinkHide, "a", false, false},
+		{SymlinkShowAsLink, "a,adangle->created2,dangle->created,in->a,newlink->new,out->outside", false, true},
+	}
+	for _, tc := range tests {
+		n, _ := sandboxFolder(t)
+		n.Symlinks = tc.policy
+
+		files, err := n.List("")
+		if got := names(files); err != nil || got != tc.list {
+			t.Errorf("policy %d: List got %q (%v), want %q", tc.policy, got, err, tc.list)
+		}
+		if _, err := n.ReadFile("out/secret"); (err == nil) != tc.outside {
+			t.Errorf("policy %d: ReadFile out/secret got %v", tc.policy, err)
+		}
+		if _, err := n.Stat("in/file"); (err == nil) != tc.inner {
+			t.Errorf("policy %d: Stat in/file got %v", tc.policy, err)
+		}
+	}
+}
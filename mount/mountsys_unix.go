@@ -0,0 +1,60 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package mount
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"sync"
+	"syscall"
+)
+
+// Cached user and group names by "u"/"g" and the ID
+var (
+	sysNames     = make(map[string]string)
+	sysNamesLock sync.Mutex
+)
+
+// sysName returns the name of a user or group ID, or the ID itself if it
+// has no name.
+func sysName(id uint32, group bool) string {
+	ids := strconv.FormatUint(uint64(id), 10)
+	key := "u" + ids
+	if group {
+		key = "g" + ids
+	}
+
+	sysNamesLock.Lock()
+	defer sysNamesLock.Unlock()
+	if name, ok := sysNames[key]; ok {
+		return name
+	}
+
+	name := ids
+	if group {
+		if g, err := user.LookupGroupId(ids); err == nil {
+			name = g.Name
+		}
+	} else {
+		if u, err := user.LookupId(ids); err == nil {
+			name = u.Username
+		}
+	}
+	sysNames[key] = name
+	return name
+}
+
+// sysFileOwner fills the owner, group, link count and unique ID of a system file.
+func sysFileOwner(info os.FileInfo, f *File) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return
+	}
+	f.Owner = sysName(st.Uid, false)
+	f.Group = sysName(st.Gid, true)
+	f.Links = int(st.Nlink)
+	f.Unique = fmt.Sprintf("%xg%x", uint64(st.Dev), uint64(st.Ino))
+}
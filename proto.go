@@ -1,6 +1,9 @@
 package ftpd
 
-var Features = []byte(" UTF8\r\n MDTM\r\n SIZE\r\n TVFS\r\n MLST type;size;modify;\r\n")
+var Features = []byte(" UTF8\r\n MDTM\r\n SIZE\r\n TVFS\r\n EPSV\r\n EPRT\r\n REST STREAM\r\n MODE Z\r\n MFMT\r\n MFF modify;\r\n")
+
+// FeaturesTLS are the features advertised in addition when Server.TLSConfig is set.
+var FeaturesTLS = []byte(" AUTH TLS\r\n AUTH SSL\r\n PBSZ\r\n PROT\r\n")
 
 var ReplyCodes = map[int][]byte{
 	200: []byte("Command okay."),
@@ -11,7 +14,7 @@ var ReplyCodes = map[int][]byte{
 	503: []byte("Bad sequence of commands."),
 	504: []byte("Command not implemented for that parameter."),
 
-	110: []byte("%s = %s"),                    // Restart Marker Reply
+	110: []byte("MARK %s = %s"),               // Restart Marker Reply
 	211: []byte("%s"),                         // System status, or system help reply.
 	212: []byte("%s"),                         // Directory status.
 	213: []byte("%s"),                         // File status (file size / modify time)
@@ -30,6 +33,8 @@ var ReplyCodes = map[int][]byte{
 	426: []byte("Connection closed; transfer aborted."),
 	//227: []byte("Entering Passive Mode (%d,%d,%d,%d,%d,%d)."),
 	227: []byte("Entering Passive Mode (%s)."),
+	229: []byte("Entering Extended Passive Mode (|||%d|)."),
+	522: []byte("Network protocol not supported, use (%s)."),
 
 	230: []byte("User logged in, proceed."),
 	530: []byte("Not logged in."),
@@ -48,7 +53,13 @@ var ReplyCodes = map[int][]byte{
 	452: []byte("Requested action not taken."),    // Insufficient storage space in system.
 	552: []byte("Requested file action aborted."), // Exceeded storage allocation (for current directory or dataset).
 	553: []byte("Requested action not taken."),    // File name not allowed.
+	554: []byte("Requested action not taken: invalid REST parameter."),
 
+	// RFC 2228 security extensions
+	234: []byte("Security data exchange complete."),                    // AUTH accepted, TLS negotiation follows.
+	431: []byte("Need some unavailable resource to process security."), // TLS not configured.
+	534: []byte("Request denied for policy reasons."),                  // TLS required.
+	536: []byte("Requested PROT level not supported by mechanism."),
 }
 
 func init() {
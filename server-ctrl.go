@@ -3,13 +3,19 @@ package ftpd
 import (
 	"bufio"
 	"bytes"
+	"compress/zlib"
+	"crypto/tls"
 	"fmt"
 	"io"
 	"log"
 	"net"
+	"os"
+	"path"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -26,14 +32,16 @@ const (
 	DataEBCDIC // Not supported
 )
 
+// Data transfer modes
 const (
 	DataStream     = iota
-	DataBlock      // Not supported
+	DataBlock      // MODE B, with restart markers (RFC 959 3.4.2)
 	DataCompressed // Not supported
+	DataDeflate    // MODE Z, zlib compressed stream (draft-preston-ftpext-deflate)
 )
 
 const (
-	DataConnActive = iota // Not supported
+	DataConnActive = iota
 	DataConnPassive
 )
 
@@ -41,550 +49,1497 @@ const (
 type ctrlState struct {
 	auth     auth.AccessType // current auth level (zero-value means no permission)
 	username string          // only store the username, verified on (USER or) PASS command
+	root     mount.Node      // root of the user's filesystem, nil if not logged in
 	wd       string          // working directory
 
-	datatype int // ASCII, Image or EBCDIC(not implemented)
-	//datamode int // Stream, Block or Compress(not implemented)
+	datatype   int    // ASCII, Image or EBCDIC(not implemented)
+	datamode   int    // Stream, Block or Deflate, Compress(not implemented)
+	zlevel     int    // Compression level for MODE Z
+	restart    int64  // REST offset for the next RETR/STOR
+	renameFrom string // RNFR path, only valid for the command right after
+
+	mlstFacts            uint   // MLST facts enabled by OPTS MLST
+	hashAlg              string // Algorithm for HASH, selected by OPTS HASH
+	rangeStart, rangeEnd int64  // RANG byte range (inclusive) for the next HASH, cleared by transfers
+	rangeSet             bool   // RANG received
 
 	activePort, pasvPort int              // Active(client-side) and Passive(server-side) ports
-	activeIP             net.IP           // Active mode target IP
+	activeIP             net.IP           // Active mode target IP, nil if no PORT/EPRT received
 	dataConnMode         int              // Data Connect mode (Active or Passive)
 	pasvListener         *net.TCPListener // Passive mode TCP Listener, nil if none
-	pasvConn             *net.TCPConn     // Passive mode Data Connection
+	epsvAll              bool             // EPSV ALL received, refuse other data connection setups
 
-	inTransfer    int32 // 0 or 1, Must be read/written by the atomic package!!!
-	transferError int32 // 0(no error) or 1(error), Must be atomic!!!
+	ctrlTLS    bool // Control connection is protected by TLS
+	implicit   bool // Implicit FTPS, data connections are always protected
+	upgradeTLS bool // AUTH accepted, upgrade the control connection after the reply
+	pbsz       bool // PBSZ received, PROT is allowed
+	protected  bool // PROT P, data connections are protected by TLS
 }
 
 var defaultCtrlState = ctrlState{
-	wd: "/",
+	wd:        "/",
+	zlevel:    zlib.DefaultCompression,
+	hashAlg:   defaultHashAlgorithm,
+	mlstFacts: defaultMLSTFacts,
+}
+
+// Session is a single control connection, along with its state.
+//
+// Its state is only touched by the control goroutine, while the data
+// connection and transfer status are shared with the transfer goroutine.
+type Session struct {
+	// Bytes transferred in the running transfer, atomic!!!
+	// First in the struct for 64-bit alignment.
+	transferBytes int64
+
+	server *Server
+	conn   io.ReadWriteCloser // can be the ones from net or crypto/tls, replaced on AUTH
+	sc     *bufio.Scanner     // line scanner over conn
+	state  ctrlState
+
+	// A buffer for forming multiline replies, reused on every command.
+	// Only used by the control goroutine.
+	buffer bytes.Buffer
+
+	wlock    sync.Mutex   // Held when writing to conn
+	replyBuf bytes.Buffer // Reply buffer for writeFTPReplySingleline, under wlock
+
+	dataLock sync.Mutex // Held when touching dataConn
+	dataConn net.Conn   // Data Connection, accepted (Passive) or dialed (Active)
+
+	inTransfer    int32  // 0 or 1, Must be read/written by the atomic package!!!
+	transferError int32  // 0(no error) or 1(error), Must be atomic!!!
+	transferCmd   string // The command line of the running transfer, control goroutine only
+
+	line       string // The command line being processed, control goroutine only
+	prelimText string // Text for the next 150/125 reply instead of the default, control goroutine only
+
+	transferOffset  int64  // File offset the next transfer starts at, for block mode restart markers
+	transferCreated string // File created for the next upload, deleted if it fails before any data arrives
+
+	shutdownOnce sync.Once // for sending the 421 on shutdown only once
+}
+
+func newSession(s *Server, conn io.ReadWriteCloser) *Session {
+	c := &Session{
+		server: s,
+		conn:   conn,
+		state:  defaultCtrlState,
+	}
+
+	// The FTP protocol is strictly Telnet(CRLF) based so
+	// we could just use bufio.Scanner with CRLF ending
+	c.sc = bufio.NewScanner(conn)
+	c.sc.Split(ScanCRLF)
+
+	if _, ok := conn.(*tls.Conn); ok {
+		// Implicit FTPS, everything is protected from the start
+		c.state.ctrlTLS = true
+		c.state.implicit = true
+		c.state.pbsz = true
+		c.state.protected = true
+	}
+	return c
+}
+
+// reply writes a single line reply. It is safe to call from the transfer goroutine.
+func (c *Session) reply(code int, params ...interface{}) {
+	c.wlock.Lock()
+	defer c.wlock.Unlock()
+	writeFTPReplySingleline(c.conn, &c.replyBuf, code, params...)
+}
+
+// replyText writes a single line reply with custom text.
+func (c *Session) replyText(code int, text string) {
+	c.wlock.Lock()
+	defer c.wlock.Unlock()
+	c.replyBuf.Reset()
+	fmt.Fprintf(&c.replyBuf, "%d %s\r\n", code, text)
+	_, err := c.replyBuf.WriteTo(c.conn)
+	if err != nil {
+		c.conn.Close()
+	}
 }
 
-// The conn can be any ReadWriteCloser (can be the ones from net or crypto/tls).
-func (s *Server) goCtrlConn(conn io.ReadWriteCloser) {
+// flush writes the formed reply in buf, closing the connection on error.
+func (c *Session) flush(buf *bytes.Buffer) {
+	c.wlock.Lock()
+	defer c.wlock.Unlock()
+	_, err := buf.WriteTo(c.conn)
+	if err != nil {
+		c.conn.Close()
+	}
+}
+
+// param returns the argument of a command, or replies 501 and returns
+// false if there is none.
+func (c *Session) param(arg string) (string, bool) {
+	if len(arg) == 0 {
+		c.reply(501)
+		return "", false
+	}
+	return arg, true
+}
+
+// pathParam is like param, but returns the argument as a path resolved
+// against the working directory.
+func (c *Session) pathParam(arg string) (string, bool) {
+	param, ok := c.param(arg)
+	if !ok {
+		return "", false
+	}
+	return resolvePath(c.state.wd, param), true
+}
+
+// closeShutdown sends 421 and closes the control connection, as the server
+// is shutting down. It is safe to call from multiple goroutines.
+func (c *Session) closeShutdown() {
+	c.shutdownOnce.Do(func() {
+		c.reply(421)
+		c.wlock.Lock()
+		c.conn.Close()
+		c.wlock.Unlock()
+	})
+}
+
+// forceClose closes the control and data connection, even during a transfer.
+func (c *Session) forceClose() {
+	c.wlock.Lock()
+	c.conn.Close()
+	c.wlock.Unlock()
+
+	c.dataLock.Lock()
+	if c.dataConn != nil {
+		c.dataConn.Close()
+	}
+	c.dataLock.Unlock()
+}
+
+// serve runs the control connection until it is closed.
+func (c *Session) serve() {
+	defer c.server.removeSession(c)
+
 	defer func() {
 		err := recover()
 		if err != nil {
 			stack := make([]byte, 8192)
 			stack = stack[:runtime.Stack(stack, false)]
-			log.Print("goCtrlConn: panic: ", err, ", stack trace:\n", string(stack))
+			log.Print("Session: panic: ", err, ", stack trace:\n", string(stack))
 		}
 	}()
 
 	// recover goes after conn.Close
-	defer conn.Close()
+	// conn is replaced on AUTH, so close the latest one
+	defer func() { c.conn.Close() }()
 
 	// Hello!
-	writeFTPReplySingleline(conn, &s.buffer, 220)
-
-	// The FTP protocol is strictly Telnet(CRLF) based so
-	// we could just use bufio.Scanner with CRLF ending
-
-	sc := bufio.NewScanner(conn)
-	sc.Split(ScanCRLF)
+	c.reply(220)
 
-	// FTP controls are stateful!
-	state := defaultCtrlState
 	defer func() { // State cleanup
-		if state.pasvListener != nil {
-			state.pasvListener.Close()
-		}
-		if state.pasvConn != nil {
-			state.pasvConn.Close()
+		c.closeDataListener()
+		c.dataLock.Lock()
+		if c.dataConn != nil {
+			c.dataConn.Close()
 		}
+		c.dataLock.Unlock()
 	}()
 
-	for sc.Scan() {
-		nline := sc.Bytes()
-		s.doCtrlLine(nline, sc, &state, conn)
+	for c.sc.Scan() {
+		c.doCtrlLine(c.sc.Bytes())
+
+		if c.state.upgradeTLS {
+			// AUTH accepted, the client starts the TLS handshake right after
+			// the 234 reply, so any buffered plaintext is dropped.
+			c.state.upgradeTLS = false
+			tconn := tls.Server(c.conn.(net.Conn), c.server.TLSConfig)
+			if err := tconn.Handshake(); err != nil {
+				log.Print("Session: TLS handshake error: ", err)
+				return
+			}
+			c.wlock.Lock()
+			c.conn = tconn
+			c.wlock.Unlock()
+			c.state.ctrlTLS = true
+
+			c.sc = bufio.NewScanner(c.conn)
+			c.sc.Split(ScanCRLF)
+		}
 	}
 }
 
-func (s *Server) doCtrlLine(line []byte, sc *bufio.Scanner, state *ctrlState, writer io.WriteCloser) {
-	// Reuse the server buffer
-	buf := &s.buffer
+func (c *Session) doCtrlLine(line []byte) {
+	s, state := c.server, &c.state
+
+	// Reuse the session buffer
+	buf := &c.buffer
 	buf.Reset()
 
+	if s.shuttingDown() {
+		// Let a running transfer complete, it closes the session after
+		if atomic.LoadInt32(&c.inTransfer) == 0 {
+			c.closeShutdown()
+		} else {
+			c.reply(421)
+		}
+		return
+	}
+
 	// Read the first word ended either by Space or CRLF
 	var cmd []byte
-	for i, c := range line {
-		if c == ' ' {
+	for i, ch := range line {
+		if ch == ' ' {
 			break
 		}
 		cmd = line[:i+1]
 	}
 
 	log.Printf("doLine: Line=\"%s\", Cmd=%s\n", line, cmd)
+	c.line = string(line)
+
+	// The argument after the command and a Space, empty if none
+	arg := commandArg(line, cmd)
+
+	// RNTO must come right after RNFR
+	renameFrom := state.renameFrom
+	state.renameFrom = ""
 
 	switch string(bytes.ToUpper(cmd)) {
 
 	// ----- ACCESS CONTROL COMMANDS ----- //
 
 	case "USER":
-		// param should begin after the command and a Space
-		param := string(line[len(cmd)+1:])
+		if s.TLSRequired && !state.ctrlTLS {
+			c.reply(534)
+			break
+		}
+		param, ok := c.param(arg)
+		if !ok {
+			break
+		}
 
 		// Reset the auth level
-		state.auth = s.Auth.Login(param, "")
-		if state.auth != auth.NoPermission {
+		if c.login(param, "") {
 			// Success
-			writeFTPReplySingleline(writer, buf, 230)
+			c.reply(230)
 		} else {
 			state.username = param
-			writeFTPReplySingleline(writer, buf, 331)
+			c.reply(331)
 		}
 	case "PASS":
+		if s.TLSRequired && !state.ctrlTLS {
+			c.reply(534)
+			break
+		}
 		if len(state.username) == 0 { // Invalid: PASS comes after USER
-			writeFTPReplySingleline(writer, buf, 503)
+			c.reply(503)
 			break
 		}
 
-		var param string
-		if len(cmd) == len(line) {
+		param := arg
+		if len(param) == 0 {
 			param = "\uffefINVALID\uffef"
-		} else {
-			param = string(line[len(cmd)+1:])
 		}
 
-		state.auth = s.Auth.Login(state.username, param)
-		if state.auth != auth.NoPermission {
-			writeFTPReplySingleline(writer, buf, 230)
+		if c.login(state.username, param) {
+			c.reply(230)
 		} else {
 			state.username = param
-			writeFTPReplySingleline(writer, buf, 530)
+			c.reply(530)
 		}
 	case "CWD":
 		if !state.auth.HasAccess(auth.ReadOnly) {
-			writeFTPReplySingleline(writer, buf, 530)
+			c.reply(530)
 			break
 		}
-		param := string(line[len(cmd)+1:])
-		var target string
-		if param[0] == '/' {
-			target = param
-		} else {
-			if state.wd == "/" {
-				target = "/" + param
-			} else {
-				target = state.wd + "/" + param
-			}
+		target, ok := c.pathParam(arg)
+		if !ok {
+			break
 		}
-		stat, err := s.Node.Stat(target)
+		stat, err := state.root.Stat(target)
 		if target == "/" || (err == nil && stat.IsDirectory) { // A folder
 			state.wd = target
-			if state.wd != "/" && state.wd[len(state.wd)-1] == '/' {
-				state.wd = state.wd[:len(state.wd)-1]
-			}
-			writeFTPReplySingleline(writer, buf, 200)
+			c.reply(200)
 		} else {
 			log.Print("doLine: warning: CWD target folder \"", target, "\" Stat failed")
-			writeFTPReplySingleline(writer, buf, 501)
+			c.reply(501)
 		}
 	case "PWD":
 		if !state.auth.HasAccess(auth.ReadOnly) {
-			writeFTPReplySingleline(writer, buf, 530)
+			c.reply(530)
 			break
 		}
-		writeFTPReplySingleline(writer, buf, 257, state.wd)
+		c.reply(257, state.wd)
 	case "CDUP":
 		if !state.auth.HasAccess(auth.ReadOnly) {
-			writeFTPReplySingleline(writer, buf, 530)
+			c.reply(530)
 			break
 		}
 		// TODO CDUP called on root directory
 		if state.wd == "/" {
-			writeFTPReplySingleline(writer, buf, 550)
+			c.reply(550)
 			break
 		}
-		newpath := state.wd[:strings.LastIndexByte(state.wd, '/')]
-		if len(newpath) == 0 {
-			newpath = "/"
-		}
-		stat, err := s.Node.Stat(newpath)
-		if err != nil || !stat.IsDirectory {
+		newpath := resolvePath(state.wd, "..")
+		stat, err := state.root.Stat(newpath)
+		if newpath != "/" && (err != nil || !stat.IsDirectory) {
 			log.Print("doLine: warning: CDUP folder \"", state.wd, "\" -> \"", newpath, "\" Stat failed")
-			writeFTPReplySingleline(writer, buf, 550)
+			c.reply(550)
 		} else {
 			//log.Print("doLine: CDUP folder \"", state.wd, "\" -> \"", newpath, "\"")
 			state.wd = newpath
-			writeFTPReplySingleline(writer, buf, 200)
+			c.reply(200)
 		}
 	case "REIN":
+		c.closeDataListener()
+		// The control connection stays protected
+		ctrlTLS, implicit := state.ctrlTLS, state.implicit
 		(*state) = defaultCtrlState
-		writeFTPReplySingleline(writer, buf, 200)
+		state.ctrlTLS, state.implicit = ctrlTLS, implicit
+		state.pbsz, state.protected = implicit, implicit
+		c.reply(200)
 	case "QUIT":
-		writeFTPReplySingleline(writer, buf, 221)
-		writer.Close()
+		c.reply(221)
+		c.conn.Close()
+
+	// ----- RFC2228/RFC4217 SECURITY COMMANDS ----- //
+
+	case "AUTH":
+		if s.TLSConfig == nil {
+			c.reply(431)
+			break
+		}
+		if _, ok := c.conn.(net.Conn); !ok || state.ctrlTLS {
+			c.reply(503)
+			break
+		}
+		param, ok := c.param(arg)
+		if !ok {
+			break
+		}
+		switch strings.ToUpper(param) {
+		case "TLS", "TLS-C", "SSL", "TLS-P":
+			// Security exchange resets the login state
+			state.auth = auth.NoPermission
+			state.username = ""
+			state.root = nil
+			state.upgradeTLS = true
+			c.reply(234)
+		default:
+			c.reply(504)
+		}
+	case "PBSZ":
+		if !state.ctrlTLS {
+			c.reply(503)
+			break
+		}
+		// TLS has no use of a protection buffer, so 0 is the only valid size
+		param, ok := c.param(arg)
+		if !ok {
+			break
+		}
+		if _, err := strconv.ParseUint(param, 10, 32); err != nil {
+			c.reply(501)
+			break
+		}
+		state.pbsz = true
+		buf.WriteString("200 PBSZ=0\r\n")
+		c.flush(buf)
+	case "PROT":
+		if !state.pbsz {
+			c.reply(503)
+			break
+		}
+		param, ok := c.param(arg)
+		if !ok {
+			break
+		}
+		switch strings.ToUpper(param) {
+		case "C":
+			if state.implicit { // Clear data connections are not allowed
+				c.reply(534)
+				break
+			}
+			state.protected = false
+			c.reply(200)
+		case "P":
+			state.protected = true
+			c.reply(200)
+		case "S", "E":
+			c.reply(536)
+		default:
+			c.reply(504)
+		}
 
 	// ----- TRANSFER PARAMETER COMMANDS ----- //
 
 	case "PORT":
 		if !state.auth.HasAccess(auth.ReadOnly) {
-			writeFTPReplySingleline(writer, buf, 530)
+			c.reply(530)
 			break
 		}
-		param := line[len(cmd)+1:]
-		state.activeIP, state.activePort = parseHostPort(param)
-		state.dataConnMode = DataConnActive
-		writeFTPReplySingleline(writer, buf, 200)
-	case "PASV":
+		if state.epsvAll {
+			c.reply(503)
+			break
+		}
+		param, ok := c.param(arg)
+		if !ok {
+			break
+		}
+		ip, port, err := parseHostPort([]byte(param))
+		if err != nil {
+			c.reply(501)
+			break
+		}
+		c.doActiveTarget(ip, port)
+	case "EPRT":
 		if !state.auth.HasAccess(auth.ReadOnly) {
-			writeFTPReplySingleline(writer, buf, 530)
+			c.reply(530)
 			break
 		}
-		// Close previous
-		if state.pasvListener != nil {
-			state.pasvListener.Close()
+		if state.epsvAll {
+			c.reply(503)
+			break
 		}
-
-		// target listen data address
-		addr := s.DataAddress
-		if len(addr) == 0 || addr == "0.0.0.0" {
-			if conn, ok := writer.(*net.TCPConn); ok {
-				// Ignoring error
-				addr, _, _ = net.SplitHostPort(conn.LocalAddr().String())
+		param, ok := c.param(arg)
+		if !ok {
+			break
+		}
+		ip, port, err := parseExtHostPort([]byte(param))
+		if err != nil {
+			if err == errUnknownNetProto {
+				c.reply(522, "1,2")
+			} else {
+				c.reply(501)
 			}
+			break
 		}
-
-		dport := s.alloPort()
-		if dport == 0 {
-			writeFTPReplySingleline(writer, buf, 421)
+		c.doActiveTarget(ip, port)
+	case "PASV":
+		if !state.auth.HasAccess(auth.ReadOnly) {
+			c.reply(530)
 			break
 		}
-		state.pasvPort = dport
-
-		l, err := net.Listen("tcp4", net.JoinHostPort(addr, strconv.Itoa(dport)))
-		state.pasvListener = l.(*net.TCPListener)
-		if err != nil {
-			writeFTPReplySingleline(writer, buf, 421)
-			log.Print("doCtrlLine: listen error: ", err)
+		if state.epsvAll {
+			c.reply(503)
 			break
 		}
+		// Close previous
+		c.closeDataListener()
 
-		_, pasvStr, err := net.SplitHostPort(state.pasvListener.Addr().String())
-		if err != nil {
-			writeFTPReplySingleline(writer, buf, 421)
+		pasvPort, ok := c.listenPassive()
+		if !ok {
 			break
 		}
-		pasvPort, err := strconv.Atoi(pasvStr)
+		hostport, err := packHostPortSlice(s.passiveAdvertiseIP(c.conn), pasvPort)
 		if err != nil {
-			writeFTPReplySingleline(writer, buf, 421)
+			// PASV is IPv4 only, the client should use EPSV
+			c.closeDataListener()
+			c.reply(425)
+			break
+		}
+		c.reply(227, hostport)
+	case "EPSV":
+		if !state.auth.HasAccess(auth.ReadOnly) {
+			c.reply(530)
 			break
 		}
-		writeFTPReplySingleline(writer, buf, 227, packHostPortSlice(net.ParseIP(s.DataAddress), pasvPort))
+		param := strings.ToUpper(arg)
+
+		network, _ := s.passiveListenAddr(c.conn)
+		switch {
+		case param == "ALL":
+			// Only EPSV is accepted from now on (RFC 2428)
+			state.epsvAll = true
+			c.reply(200)
+		case param == "1" && network != "tcp4", param == "2" && network != "tcp6":
+			c.reply(522, networkProtoString(network))
+		case param == "", param == "1", param == "2":
+			// Close previous
+			c.closeDataListener()
+
+			pasvPort, ok := c.listenPassive()
+			if ok {
+				c.reply(229, pasvPort)
+			}
+		default:
+			c.reply(522, networkProtoString(network))
+		}
 	case "TYPE":
 		if !state.auth.HasAccess(auth.ReadOnly) {
-			writeFTPReplySingleline(writer, buf, 530)
+			c.reply(530)
 			break
 		}
-		param := line[len(cmd)+1:]
-		switch string(param) {
+		param, ok := c.param(arg)
+		if !ok {
+			break
+		}
+		switch param {
 		case "A":
 			state.datatype = DataASCII
-			writeFTPReplySingleline(writer, buf, 200)
+			c.reply(200)
 		case "I":
 			state.datatype = DataImage
-			writeFTPReplySingleline(writer, buf, 200)
+			c.reply(200)
 		case "E":
-			writeFTPReplySingleline(writer, buf, 504)
+			c.reply(504)
 		default:
-			writeFTPReplySingleline(writer, buf, 501)
+			c.reply(501)
 		}
 	case "STRU":
 		if !state.auth.HasAccess(auth.ReadOnly) {
-			writeFTPReplySingleline(writer, buf, 530)
+			c.reply(530)
+			break
+		}
+		param, ok := c.param(arg)
+		if !ok {
 			break
 		}
-		param := line[len(cmd)+1:]
-		switch string(param) {
+		switch param {
 		case "F":
-			writeFTPReplySingleline(writer, buf, 200)
+			c.reply(200)
 		case "R", "P":
-			writeFTPReplySingleline(writer, buf, 504)
+			c.reply(504)
 		default:
-			writeFTPReplySingleline(writer, buf, 501)
+			c.reply(501)
 		}
 	case "MODE":
 		if !state.auth.HasAccess(auth.ReadOnly) {
-			writeFTPReplySingleline(writer, buf, 530)
+			c.reply(530)
+			break
+		}
+		param, ok := c.param(arg)
+		if !ok {
 			break
 		}
-		param := line[len(cmd)+1:]
-		switch string(param) {
+		switch param {
 		case "S":
-			//state.datamode = DataStream
-			writeFTPReplySingleline(writer, buf, 200)
-		case "B", "C":
-			writeFTPReplySingleline(writer, buf, 504)
+			state.datamode = DataStream
+			c.reply(200)
+		case "B":
+			state.datamode = DataBlock
+			c.reply(200)
+		case "Z":
+			state.datamode = DataDeflate
+			c.reply(200)
+		case "C":
+			c.reply(504)
 		default:
-			writeFTPReplySingleline(writer, buf, 501)
+			c.reply(501)
 		}
 
 	// ----- FTP SERVICE COMMANDS ----- //
 
 	case "ABOR":
 		if !state.auth.HasAccess(auth.ReadOnly) {
-			writeFTPReplySingleline(writer, buf, 530)
+			c.reply(530)
 			break
 		}
-		if state.pasvConn == nil {
-			writeFTPReplySingleline(writer, buf, 226)
+		c.dataLock.Lock()
+		if c.dataConn == nil {
+			c.dataLock.Unlock()
+			c.reply(226)
 			break
 		}
-		if atomic.LoadInt32(&state.inTransfer) != 0 {
-			atomic.StoreInt32(&state.transferError, 1)
-			state.pasvConn.Close()
+		if atomic.LoadInt32(&c.inTransfer) != 0 {
+			atomic.StoreInt32(&c.transferError, 1)
+			c.dataConn.Close()
+			c.dataLock.Unlock()
 			// Actively wait for the data connection to finish.
-			for atomic.LoadInt32(&state.inTransfer) != 0 {
+			for atomic.LoadInt32(&c.inTransfer) != 0 {
 				//runtime.Gosched()
 				time.Sleep(time.Millisecond)
 			}
 		} else {
-			state.pasvConn.Close()
-			state.pasvConn = nil
+			c.dataConn.Close()
+			c.dataConn = nil
+			c.dataLock.Unlock()
 		}
-		writeFTPReplySingleline(writer, buf, 226)
+		c.reply(226)
 
-	// TODO Active Mode Data Connection
+	case "REST":
+		if !state.auth.HasAccess(auth.ReadOnly) {
+			c.reply(530)
+			break
+		}
+		// The marker is the byte offset (RFC 3659), which is
+		// also what the restart markers in block mode carry
+		param, ok := c.param(arg)
+		if !ok {
+			break
+		}
+		offset, err := strconv.ParseInt(param, 10, 64)
+		if err != nil || offset < 0 {
+			c.reply(501)
+			break
+		}
+		state.restart = offset
+		fmt.Fprintf(buf, "350 Restarting at %d. Send STORE or RETRIEVE to initiate transfer.\r\n", offset)
+		c.flush(buf)
 	case "RETR":
 		if !state.auth.HasAccess(auth.ReadOnly) {
-			writeFTPReplySingleline(writer, buf, 530)
+			c.reply(530)
 			break
 		}
-		param := line[len(cmd)+1:]
-		f, err := s.Node.ReadFile(state.wd + "/" + string(param))
-		if err != nil {
-			writeFTPReplySingleline(writer, buf, 550)
+		param, ok := c.pathParam(arg)
+		if !ok {
+			break
+		}
+		f, err := mount.ReadFileAt(state.root, param, state.restart)
+		c.transferOffset, state.restart = state.restart, 0
+		state.rangeSet = false // RANG only applies to HASH
+		if err == mount.ErrInvalidOffset {
+			c.reply(554)
+		} else if err != nil {
+			c.reply(550)
 		} else {
-			s.writeToDataConn(f, sc, state, writer)
+			c.writeToDataConn(f)
 		}
 	case "STOR":
 		if !state.auth.HasAccess(auth.ReadWrite) {
-			writeFTPReplySingleline(writer, buf, 530)
+			c.reply(530)
 			break
 		}
-		param := line[len(cmd)+1:]
-		f, err := s.Node.WriteFile(state.wd + "/" + string(param))
-		if err != nil {
-			writeFTPReplySingleline(writer, buf, 550)
+		param, ok := c.pathParam(arg)
+		if !ok {
+			break
+		}
+		f, err := mount.WriteFileAt(state.root, param, state.restart)
+		c.transferOffset, state.restart = state.restart, 0
+		state.rangeSet = false
+		if err == mount.ErrInvalidOffset {
+			c.reply(554)
+		} else if err != nil {
+			c.reply(550)
+		} else {
+			c.readFromDataConn(f)
+		}
+	case "STOU":
+		if !state.auth.HasAccess(auth.ReadWrite) {
+			c.reply(530)
+			break
+		}
+		// An argument, though not in RFC 959, is taken as the base name
+		state.restart, state.rangeSet = 0, false
+
+		name, f, err := createUnique(state.root, state.wd, arg)
+		if err == mount.ErrNotSupported {
+			c.reply(502)
+		} else if err != nil {
+			c.reply(550)
 		} else {
-			s.readFromDataConn(f, sc, state, writer)
+			// RFC 1123 4.1.2.9
+			c.prelimText = "FILE: " + name
+			c.transferCreated = resolvePath(state.wd, name)
+			c.readFromDataConn(f)
 		}
 	case "APPE":
 		if !state.auth.HasAccess(auth.ReadWrite) {
-			writeFTPReplySingleline(writer, buf, 530)
+			c.reply(530)
+			break
+		}
+		param, ok := c.pathParam(arg)
+		if !ok {
 			break
 		}
-		param := line[len(cmd)+1:]
-		f, err := s.Node.AppendFile(state.wd + "/" + string(param))
+		state.restart, state.rangeSet = 0, false // Appending ignores the restart marker
+		if stat, err := state.root.Stat(param); err == nil {
+			c.transferOffset = stat.Size
+		}
+		f, err := state.root.AppendFile(param)
 		if err != nil {
-			writeFTPReplySingleline(writer, buf, 550)
+			c.reply(550)
+		} else {
+			c.readFromDataConn(f)
+		}
+	case "RNFR":
+		if !state.auth.HasAccess(auth.ReadWrite) {
+			c.reply(530)
+			break
+		}
+		param, ok := c.pathParam(arg)
+		if !ok {
+			break
+		}
+		if _, err := state.root.Stat(param); err != nil {
+			c.reply(550)
+			break
+		}
+		state.renameFrom = param
+		c.reply(350)
+	case "RNTO":
+		if !state.auth.HasAccess(auth.ReadWrite) {
+			c.reply(530)
+			break
+		}
+		if len(renameFrom) == 0 {
+			c.reply(503)
+			break
+		}
+		param, ok := c.pathParam(arg)
+		if !ok {
+			break
+		}
+		err := state.root.Rename(renameFrom, param)
+		if err == mount.ErrCrossMount {
+			c.replyText(553, "Cannot rename across mount points.")
+		} else if err != nil {
+			log.Print("doLine: warning: rename \"", renameFrom, "\" -> \"", param, "\" failed: ", err)
+			c.reply(550)
 		} else {
-			s.readFromDataConn(f, sc, state, writer)
+			c.reply(250)
 		}
 	case "DELE":
 		if !state.auth.HasAccess(auth.ReadWrite) {
-			writeFTPReplySingleline(writer, buf, 530)
+			c.reply(530)
+			break
+		}
+		param, ok := c.pathParam(arg)
+		if !ok {
 			break
 		}
-		param := line[len(cmd)+1:]
-		err := s.Node.DeleteFile(state.wd + "/" + string(param))
+		err := state.root.DeleteFile(param)
 		if err != nil {
-			writeFTPReplySingleline(writer, buf, 550)
+			c.reply(550)
 		} else {
-			writeFTPReplySingleline(writer, buf, 200)
+			c.reply(200)
 		}
 	case "RMD":
 		if !state.auth.HasAccess(auth.ReadWrite) {
-			writeFTPReplySingleline(writer, buf, 530)
+			c.reply(530)
+			break
+		}
+		param, ok := c.pathParam(arg)
+		if !ok {
 			break
 		}
-		param := line[len(cmd)+1:]
-		err := s.Node.RemoveDirectory(state.wd + "/" + string(param))
+		err := state.root.RemoveDirectory(param)
 		if err != nil {
-			writeFTPReplySingleline(writer, buf, 550)
+			c.reply(550)
 		} else {
-			writeFTPReplySingleline(writer, buf, 200)
+			c.reply(200)
 		}
 	case "MKD":
 		if !state.auth.HasAccess(auth.ReadWrite) {
-			writeFTPReplySingleline(writer, buf, 530)
+			c.reply(530)
 			break
 		}
-		param := line[len(cmd)+1:]
-		err := s.Node.MakeDirectory(state.wd + "/" + string(param))
+		param, ok := c.pathParam(arg)
+		if !ok {
+			break
+		}
+		err := state.root.MakeDirectory(param)
 		if err != nil {
-			writeFTPReplySingleline(writer, buf, 550)
+			c.reply(550)
 		} else {
-			writeFTPReplySingleline(writer, buf, 200)
+			c.reply(200)
 		}
 
 	// ----- RFC3659 EXTENSION COMMANDS ----- //
 
 	case "SIZE":
 		if !state.auth.HasAccess(auth.ReadOnly) {
-			writeFTPReplySingleline(writer, buf, 530)
+			c.reply(530)
 			break
 		}
-		param := state.wd + "/" + string(line[len(cmd)+1:])
-		if state.wd == "/" { // param="//dir"
-			param = param[1:]
+		param, ok := c.pathParam(arg)
+		if !ok {
+			break
 		}
-		stat, err := s.Node.Stat(param)
+		stat, err := state.root.Stat(param)
 		if err != nil {
-			writeFTPReplySingleline(writer, buf, 550)
-		} else {
-			writeFTPReplySingleline(writer, buf, 213, strconv.FormatInt(stat.Size, 10))
+			c.reply(550)
+			break
+		}
+		if state.datatype == DataASCII && !stat.IsDirectory {
+			// The size is the one to be transferred in the current TYPE (RFC 3659)
+			if stat.Size > maxASCIISize {
+				c.reply(550)
+				break
+			}
+			stat.Size, err = asciiSize(state.root, param)
+			if err != nil {
+				c.reply(550)
+				break
+			}
 		}
+		c.reply(213, strconv.FormatInt(stat.Size, 10))
 	case "MDTM":
 		if !state.auth.HasAccess(auth.ReadOnly) {
-			writeFTPReplySingleline(writer, buf, 530)
+			c.reply(530)
 			break
 		}
-		param := state.wd + "/" + string(line[len(cmd)+1:])
-		if state.wd == "/" { // param="//dir"
-			param = param[1:]
+		param, ok := c.pathParam(arg)
+		if !ok {
+			break
 		}
-		stat, err := s.Node.Stat(param)
+		stat, err := state.root.Stat(param)
 		if err != nil {
-			writeFTPReplySingleline(writer, buf, 550)
+			c.reply(550)
 		} else {
-			writeFTPReplySingleline(writer, buf, 213, ftpTime(stat.LastModify))
+			c.reply(213, ftpTime(stat.LastModify))
 		}
-	case "MLST":
-		if !state.auth.HasAccess(auth.ReadOnly) {
-			writeFTPReplySingleline(writer, buf, 530)
+	case "MFMT":
+		if !state.auth.HasAccess(auth.ReadWrite) {
+			c.reply(530)
+			break
+		}
+		// MFMT <time> <path> (draft-somers-ftp-mfxx)
+		params := strings.SplitN(arg, " ", 2)
+		if len(params) != 2 {
+			c.reply(501)
+			break
+		}
+		mtime, err := parseFTPTime(params[0])
+		if err != nil {
+			c.reply(501)
 			break
 		}
-		var param string
-		if len(line) == len(cmd) {
-			param = state.wd
+		param := resolvePath(state.wd, params[1])
+		err = mount.SetModTime(state.root, param, mtime)
+		if err == mount.ErrNotSupported {
+			c.reply(502)
+		} else if err != nil {
+			c.reply(550)
 		} else {
-			param = state.wd + "/" + string(line[len(cmd)+1:])
-			if state.wd == "/" { // param="//dir"
-				param = param[1:]
+			c.replyText(213, "Modify="+ftpTime(mtime)+"; "+params[1])
+		}
+	case "MFF":
+		if !state.auth.HasAccess(auth.ReadWrite) {
+			c.reply(530)
+			break
+		}
+		// MFF fact=value;...; <path>, only modify is supported
+		params := strings.SplitN(arg, " ", 2)
+		if len(params) != 2 {
+			c.reply(501)
+			break
+		}
+		var mtime time.Time
+		code := 0 // Error reply code
+		for _, fact := range strings.Split(strings.TrimSuffix(params[0], ";"), ";") {
+			eq := strings.IndexByte(fact, '=')
+			if eq == -1 {
+				code = 501
+				break
+			}
+			if !strings.EqualFold(fact[:eq], "modify") {
+				code = 504
+				break
 			}
+			var err error
+			if mtime, err = parseFTPTime(fact[eq+1:]); err != nil {
+				code = 501
+				break
+			}
+		}
+		if code == 0 && mtime.IsZero() {
+			code = 501
+		}
+		if code != 0 {
+			c.reply(code)
+			break
+		}
+		param := resolvePath(state.wd, params[1])
+		err := mount.SetModTime(state.root, param, mtime)
+		if err == mount.ErrNotSupported {
+			c.reply(502)
+		} else if err != nil {
+			c.reply(550)
+		} else {
+			c.replyText(213, "modify="+ftpTime(mtime)+"; "+params[1])
+		}
+	case "HASH":
+		if !state.auth.HasAccess(auth.ReadOnly) {
+			c.reply(530)
+			break
+		}
+		name, ok := c.param(arg)
+		if !ok {
+			break
+		}
+		param := resolvePath(state.wd, name)
+		start, end := int64(0), int64(-1)
+		if state.rangeSet {
+			start, end = state.rangeStart, state.rangeEnd
+			state.rangeSet = false
+		}
+		sum, end, err := s.fileHash(state.root, param, state.hashAlg, start, end)
+		switch err {
+		case nil:
+			c.replyText(213, fmt.Sprintf("%s %d-%d %s %s", state.hashAlg, start, end, sum, name))
+		case mount.ErrInvalidOffset:
+			c.reply(554)
+		default:
+			c.reply(550)
+		}
+	case "RANG":
+		if !state.auth.HasAccess(auth.ReadOnly) {
+			c.reply(530)
+			break
+		}
+		var start, end int64
+		if n, err := fmt.Sscanf(arg, "%d %d", &start, &end); n != 2 || err != nil || start < 0 {
+			c.reply(501)
+			break
+		}
+		if start == 1 && end == 0 {
+			// RANG 1 0 resets the range (draft-bryan-ftp-range)
+			state.rangeSet = false
+			c.replyText(350, "Restart range reset.")
+			break
 		}
-		stat, err := s.Node.Stat(param)
+		if end < start {
+			c.reply(501)
+			break
+		}
+		state.rangeStart, state.rangeEnd, state.rangeSet = start, end, true
+		c.replyText(350, fmt.Sprintf("Restarting at %d. End byte range at %d.", start, end))
+	case "XCRC", "XMD5", "XSHA1", "XSHA256", "XSHA512":
+		if !state.auth.HasAccess(auth.ReadOnly) {
+			c.reply(530)
+			break
+		}
+		param, ok := c.pathParam(arg)
+		if !ok {
+			break
+		}
+		sum, _, err := s.fileHash(state.root, param, legacyHashCommands[string(bytes.ToUpper(cmd))], 0, -1)
+		if err != nil {
+			c.reply(550)
+		} else {
+			c.replyText(250, sum)
+		}
+	case "MLST":
+		if !state.auth.HasAccess(auth.ReadOnly) {
+			c.reply(530)
+			break
+		}
+		param := resolvePath(state.wd, arg)
+		stat, err := state.root.Stat(param)
 		if err != nil {
-			writeFTPReplySingleline(writer, buf, 550)
+			c.reply(550)
 			break
 		}
 		buf.WriteString("250- Listing starting\r\n ")
-		formatMLSXString(buf, &stat)
+		formatMLSXString(buf, &stat, param, "", state.mlstFacts, state.auth)
 		buf.WriteString("\r\n250 End\r\n")
-		buf.WriteTo(writer)
+		c.flush(buf)
 	case "MLSD":
 		if !state.auth.HasAccess(auth.ReadOnly) {
-			writeFTPReplySingleline(writer, buf, 530)
+			c.reply(530)
 			break
 		}
-		var param string
-		if len(line) == len(cmd) {
-			param = state.wd
-		} else {
-			param = state.wd + "/" + string(line[len(cmd)+1:])
-			if state.wd == "/" { // param="//dir"
-				param = param[1:]
-			}
-		}
-		list, err := s.Node.List(param)
+		param := resolvePath(state.wd, arg)
+		list, err := state.root.List(param)
 		if err != nil {
 			if err == mount.ErrNotFolder {
-				writeFTPReplySingleline(writer, buf, 501)
+				c.reply(501)
 			} else {
-				writeFTPReplySingleline(writer, buf, 550)
+				c.reply(550)
 			}
 			break
 		}
 
-		s.writeToDataConn(newMLSDWriter(list), sc, state, writer)
+		o := newMLSDWriter(state.mlstFacts, state.auth)
+		if stat, err := state.root.Stat(param); err == nil {
+			o.add(&stat, ".", "cdir")
+		}
+		if parent := path.Dir(path.Clean(param)); parent != path.Clean(param) {
+			if stat, err := state.root.Stat(parent); err == nil {
+				o.add(&stat, "..", "pdir")
+			}
+		}
+		for _, f := range list {
+			if f.Name != "." && f.Name != ".." {
+				o.add(&f, f.Name, "")
+			}
+		}
+		c.writeToDataConn(o)
 
 	case "LIST":
 		if !state.auth.HasAccess(auth.ReadOnly) {
-			writeFTPReplySingleline(writer, buf, 530)
+			c.reply(530)
 			break
 		}
-		list, err := s.Node.List(state.wd)
+		param := arg
+		flags, name := parseListArgs(param)
+
+		target := resolvePath(state.wd, name)
+		stat, err := state.root.Stat(target)
 		if err != nil {
-			if err == mount.ErrNotFolder {
-				writeFTPReplySingleline(writer, buf, 501)
-			} else {
-				writeFTPReplySingleline(writer, buf, 550)
+			c.reply(550)
+			break
+		}
+
+		l := &lister{
+			node:    state.root,
+			flags:   flags,
+			permstr: permString(state.auth),
+			year:    time.Now().Year(),
+			visited: map[string]bool{stat.Unique: true},
+		}
+		if !stat.IsDirectory {
+			// Files are listed by the name given
+			stat.Name = name
+			formatListString(&l.buf, &stat, l.permstr, l.year)
+			l.buf.WriteString("\r\n")
+		} else {
+			if len(name) == 0 {
+				name = "."
+			}
+			if err = l.list(target, name, 0); err != nil {
+				c.reply(550)
+				break
 			}
+		}
+
+		// lister.buf is not reused, so it can be sent async
+		c.writeToDataConn(&l.buf)
+
+	case "NLST":
+		if !state.auth.HasAccess(auth.ReadOnly) {
+			c.reply(530)
 			break
 		}
+		param := arg
 
-		var permstr string
-		switch state.auth {
-		case auth.ReadOnly:
-			permstr = "r--r--r--"
-		case auth.ReadWrite:
-			permstr = "rw-rw-rw-"
+		// Split off a glob pattern on the last path element
+		dir, pattern := param, ""
+		if id := strings.LastIndexByte(param, '/'); strings.ContainsAny(param[id+1:], "*?[") {
+			dir, pattern = param[:id+1], param[id+1:]
 		}
 
-		year := time.Now().Year()
-		// We need a new buffer for async send
+		target := resolvePath(state.wd, dir)
+
+		names, isDir, err := nameList(state.root, target, pattern)
+		if err != nil {
+			c.reply(550)
+			break
+		}
+		if len(names) == 0 && len(pattern) != 0 {
+			c.reply(450) // Nothing matched
+			break
+		}
+
+		// Names are given relative to the argument, so they can be fed back to RETR
+		if !isDir {
+			names, dir = []string{param}, ""
+		} else if len(dir) != 0 && dir[len(dir)-1] != '/' {
+			dir += "/"
+		}
 		buf := &bytes.Buffer{}
-		for _, f := range list {
-			if f.IsDirectory {
-				buf.WriteByte('d')
-			} else {
-				buf.WriteByte('-')
-			}
-			buf.WriteString(permstr)
-			buf.WriteString(" 1 user group ")
-			var t string
-			// Refer to https://cr.yp.to/ftp/list/binls.html for
-			// details on the /bin/ls format.
-			if f.LastModify.Year() != year {
-				t = f.LastModify.Format("Jan _2 2006")
-			} else {
-				t = f.LastModify.Format("Jan _2 15:04")
-			}
-			fmt.Fprintf(buf, "%12d %s %s\r\n", f.Size, t, f.Name)
+		for _, name := range names {
+			buf.WriteString(dir)
+			buf.WriteString(name)
+			buf.WriteString("\r\n")
 		}
 
-		s.writeToDataConn(buf, sc, state, writer)
+		c.writeToDataConn(buf)
 
 	// ----- OTHER EXTENSION COMMANDS ----- //
 
 	case "FEAT":
 		buf.WriteString("211- Features supported\r\n")
 		buf.Write(Features)
-		buf.WriteString("211 End\r\n")
-		_, err := buf.WriteTo(writer)
-		if err != nil {
-			writer.Close()
+		buf.WriteString(hashFeature(state.hashAlg))
+		buf.WriteString(mlstFeature(state.mlstFacts))
+		if s.TLSConfig != nil {
+			buf.Write(FeaturesTLS)
 		}
+		buf.WriteString("211 End\r\n")
+		c.flush(buf)
 
 	case "SYST":
 		// Write "UNIX Type: L8" as described in https://cr.yp.to/ftp/syst.html
 		buf.WriteString("215 UNIX Type: L8\r\n")
-		_, err := buf.WriteTo(writer)
+		c.flush(buf)
+
+	case "OPTS":
+		param := strings.ToUpper(arg)
+		c.doOptions(strings.Fields(param))
+
+	case "STAT":
+		if len(arg) == 0 {
+			c.doStatus()
+			break
+		}
+		if !state.auth.HasAccess(auth.ReadOnly) {
+			c.reply(530)
+			break
+		}
+		param, ok := c.pathParam(arg)
+		if !ok {
+			break
+		}
+
+		// Like LIST, but over the control connection
+		stat, err := state.root.Stat(param)
 		if err != nil {
-			writer.Close()
+			c.reply(550)
+			break
+		}
+		list := []mount.File{stat}
+		if stat.IsDirectory {
+			list, err = state.root.List(param)
+			if err != nil {
+				c.reply(550)
+				break
+			}
 		}
 
+		// 212 for directory status, 213 for file status (RFC 959)
+		code := 213
+		if stat.IsDirectory {
+			code = 212
+		}
+		permstr := permString(state.auth)
+		year := time.Now().Year()
+		fmt.Fprintf(buf, "%d-Status follows:\r\n", code)
+		for _, f := range list {
+			buf.WriteByte(' ')
+			formatListString(buf, &f, permstr, year)
+			buf.WriteString("\r\n")
+		}
+		fmt.Fprintf(buf, "%d End of status\r\n", code)
+		c.flush(buf)
+
 	case "ALLO", "NOOP":
-		writeFTPReplySingleline(writer, buf, 200)
-	case "ACCT", "STOU", "REST", "NLST", "SITE", "STAT":
-		writeFTPReplySingleline(writer, buf, 502) // Command not Implemented
+		c.reply(200)
+	case "ACCT", "SITE":
+		c.reply(502) // Command not Implemented
 	default:
-		writeFTPReplySingleline(writer, buf, 500)
+		c.reply(500)
 	}
 }
 
-type mlsdWriter struct {
-	files []mount.File
-	bytes.Buffer
+// login checks the username/password pair, and sets up the access level
+// and the filesystem root of the session on success.
+//
+// A user whose home folder is missing cannot log in.
+func (c *Session) login(username, password string) bool {
+	s, state := c.server, &c.state
+
+	state.auth = s.Auth.Login(username, password)
+	if state.auth == auth.NoPermission {
+		return false
+	}
+
+	state.root, state.wd = s.Node, "/"
+	if r, ok := s.Auth.(auth.Root); ok {
+		node, home := r.Root(username)
+		if node != nil {
+			state.root = node
+		}
+		if home = resolvePath("/", home); home != "/" {
+			if stat, err := state.root.Stat(home); err != nil || !stat.IsDirectory {
+				log.Printf("login: user %s home folder \"%s\" Stat failed", username, home)
+				state.auth, state.root = auth.NoPermission, nil
+				return false
+			}
+			state.root = mount.Chroot(state.root, home)
+		}
+	}
+	return true
+}
+
+// doStatus replies to a bare STAT command with the session status, including
+// the progress of the running transfer, if any.
+func (c *Session) doStatus() {
+	state, buf := &c.state, &c.buffer
+
+	buf.WriteString("211-FTP server status:\r\n")
+	if conn, ok := c.conn.(net.Conn); ok {
+		fmt.Fprintf(buf, " Connected to %s\r\n", conn.RemoteAddr())
+	}
+	if !state.auth.HasAccess(auth.ReadOnly) {
+		buf.WriteString(" Not logged in\r\n")
+		buf.WriteString("211 End of status\r\n")
+		c.flush(buf)
+		return
+	}
+	fmt.Fprintf(buf, " Logged in as %s\r\n", state.username)
+	fmt.Fprintf(buf, " Working directory %s\r\n", state.wd)
+
+	typestr := "ASCII"
+	if state.datatype == DataImage {
+		typestr = "BINARY"
+	}
+	modestr := "Stream"
+	switch state.datamode {
+	case DataBlock:
+		modestr = "Block"
+	case DataDeflate:
+		modestr = "Deflate"
+	}
+	fmt.Fprintf(buf, " TYPE: %s, STRUcture: File, MODE: %s\r\n", typestr, modestr)
+
+	switch {
+	case state.dataConnMode == DataConnPassive && state.pasvListener != nil:
+		fmt.Fprintf(buf, " Data connection: passive, listening on port %d\r\n", state.pasvPort)
+	case state.dataConnMode == DataConnActive && state.activeIP != nil:
+		fmt.Fprintf(buf, " Data connection: active, to %s\r\n", net.JoinHostPort(state.activeIP.String(), strconv.Itoa(state.activePort)))
+	default:
+		buf.WriteString(" Data connection: not set up\r\n")
+	}
+	if state.ctrlTLS {
+		if state.protected {
+			buf.WriteString(" Control and data connections protected by TLS\r\n")
+		} else {
+			buf.WriteString(" Control connection protected by TLS\r\n")
+		}
+	}
+
+	if atomic.LoadInt32(&c.inTransfer) != 0 {
+		fmt.Fprintf(buf, " Transfer in progress: %s, %d bytes transferred\r\n", c.transferCmd, atomic.LoadInt64(&c.transferBytes))
+	} else {
+		buf.WriteString(" No transfer in progress\r\n")
+	}
+
+	buf.WriteString("211 End of status\r\n")
+	c.flush(buf)
+}
+
+// doOptions replies to OPTS, with the parameters split into words.
+func (c *Session) doOptions(params []string) {
+	state := &c.state
+	if len(params) == 0 {
+		c.reply(501)
+		return
+	}
+
+	switch params[0] {
+	case "UTF8":
+		// We are always in UTF-8
+		if len(params) == 2 && params[1] == "ON" {
+			c.reply(200)
+		} else {
+			c.reply(501)
+		}
+	case "MLST":
+		// OPTS MLST [fact;fact;...] (RFC 3659 7.9)
+		var list string
+		if len(params) == 2 {
+			list = params[1]
+		} else if len(params) != 1 {
+			c.reply(501)
+			return
+		}
+		state.mlstFacts = parseMLSTFacts(list)
+		c.replyText(200, strings.TrimSpace("MLST OPTS "+mlstFactString(state.mlstFacts)))
+	case "HASH":
+		// OPTS HASH [algorithm]
+		if len(params) == 2 {
+			if findHashAlgorithm(params[1]) == nil {
+				c.reply(501)
+				return
+			}
+			state.hashAlg = params[1]
+		} else if len(params) != 1 {
+			c.reply(501)
+			return
+		}
+		c.replyText(200, state.hashAlg)
+	case "MODE":
+		// OPTS MODE Z LEVEL <n>
+		if len(params) != 4 || params[1] != "Z" || params[2] != "LEVEL" {
+			c.reply(501)
+			return
+		}
+		level, err := strconv.Atoi(params[3])
+		if err != nil || level < zlib.NoCompression || level > zlib.BestCompression {
+			c.reply(501)
+			return
+		}
+		state.zlevel = level
+		c.replyText(200, "MODE Z LEVEL set to "+params[3]+".")
+	default:
+		c.reply(501)
+	}
+}
+
+// doActiveTarget sets the active mode data connection target from a
+// PORT/EPRT command, replying 200 on success.
+//
+// The target host must be the client itself, and the port must not be a
+// privileged one, which prevents the server from being used in a FTP
+// bounce attack (RFC 2577).
+func (c *Session) doActiveTarget(ip net.IP, port int) {
+	state := &c.state
+	if conn, ok := c.conn.(net.Conn); ok {
+		if raddr, ok := conn.RemoteAddr().(*net.TCPAddr); ok && !raddr.IP.Equal(ip) {
+			log.Print("doLine: warning: active target ", ip, " is not the client ", raddr.IP)
+			c.reply(504)
+			return
+		}
+	}
+	if port < 1024 {
+		c.reply(504)
+		return
+	}
+
+	c.closeDataListener()
+	state.activeIP, state.activePort = ip, port
+	state.dataConnMode = DataConnActive
+	c.reply(200)
+}
+
+// listFlags are the ls-style flags of LIST.
+type listFlags struct {
+	all       bool // -a, list dotfiles
+	recursive bool // -R, list subfolders recursively
+	byTime    bool // -t, sort by modification time, newest first
 }
 
-func newMLSDWriter(files []mount.File) io.Reader {
-	o := &mlsdWriter{files: files}
+// Maximum depth of a recursive LIST
+const maxListDepth = 16
+
+// parseListArgs splits the argument of LIST into the leading flags and
+// the path. Unknown flags, like -l, are ignored.
+func parseListArgs(param string) (flags listFlags, name string) {
+	for strings.HasPrefix(param, "-") {
+		var word string
+		if i := strings.IndexByte(param, ' '); i != -1 {
+			word, param = param[1:i], strings.TrimLeft(param[i+1:], " ")
+		} else {
+			word, param = param[1:], ""
+		}
+		for _, ch := range word {
+			switch ch {
+			case 'a':
+				flags.all = true
+			case 'R':
+				flags.recursive = true
+			case 't':
+				flags.byTime = true
+			}
+		}
+	}
+	return flags, param
+}
+
+// lister forms a LIST listing, like /bin/ls -l.
+type lister struct {
+	node    mount.Node
+	flags   listFlags
+	permstr string
+	year    int
+	buf     bytes.Buffer
+
+	// Unique IDs of the folders listed, so that a folder reached again
+	// through a symlink is not listed over and over in a recursive listing
+	visited map[string]bool
+}
+
+// list lists the folder dir, shown as name in a recursive listing.
+func (l *lister) list(dir, name string, depth int) error {
+	files, err := l.node.List(dir)
+	if err != nil {
+		return err
+	}
+
+	shown := files[:0]
+	for _, f := range files {
+		if l.flags.all || !strings.HasPrefix(f.Name, ".") {
+			shown = append(shown, f)
+		}
+	}
+	files = shown
+	if l.flags.byTime {
+		sort.SliceStable(files, func(i, j int) bool { return files[i].LastModify.After(files[j].LastModify) })
+	} else {
+		sort.Slice(files, func(i, j int) bool { return files[i].Name < files[j].Name })
+	}
+
+	if l.flags.recursive {
+		if depth != 0 {
+			l.buf.WriteString("\r\n")
+		}
+		l.buf.WriteString(name + ":\r\n")
+	}
 	for _, f := range files {
-		formatMLSXString(o, &f)
-		o.WriteString("\r\n")
+		formatListString(&l.buf, &f, l.permstr, l.year)
+		l.buf.WriteString("\r\n")
+	}
+
+	if l.flags.recursive && depth < maxListDepth {
+		for _, f := range files {
+			if !f.IsDirectory || f.Name == "." || f.Name == ".." {
+				continue
+			}
+			if len(f.Unique) != 0 {
+				if l.visited[f.Unique] {
+					continue
+				}
+				l.visited[f.Unique] = true
+			}
+			// Unreadable subfolders are skipped
+			l.list(resolvePath(dir, f.Name), path.Join(name, f.Name), depth+1)
+		}
+	}
+	return nil
+}
+
+// nameList returns the sorted names of the files in the folder target
+// matching the glob pattern (all files if empty), or isDir=false if
+// target is a file.
+func nameList(node mount.Node, target, pattern string) (names []string, isDir bool, err error) {
+	stat, err := node.Stat(target)
+	if err != nil {
+		return nil, false, err
+	}
+	if !stat.IsDirectory {
+		return nil, false, nil
+	}
+
+	list, err := node.List(target)
+	if err != nil {
+		return nil, true, err
+	}
+	names = make([]string, 0, len(list))
+	for _, f := range list {
+		if len(pattern) != 0 {
+			if ok, _ := path.Match(pattern, f.Name); !ok {
+				continue
+			}
+		}
+		names = append(names, f.Name)
+	}
+	sort.Strings(names)
+	return names, true, nil
+}
+
+// createUnique creates a file with a name not yet used in the folder dir,
+// based on the last path element of base if not empty, returning the name
+// chosen.
+func createUnique(node mount.Node, dir, base string) (name string, f io.Writer, err error) {
+	if base = path.Base(resolvePath("/", base)); base == "/" {
+		base = "ftpd." + strconv.FormatInt(time.Now().UnixNano(), 36)
+	}
+
+	name = base
+	for i := 1; i <= 100; i++ {
+		f, err = mount.CreateFile(node, resolvePath(dir, name))
+		if !os.IsExist(err) {
+			return
+		}
+		name = base + "." + strconv.Itoa(i)
 	}
-	return o
+	return "", nil, err
+}
+
+// mlsdWriter forms a MLSD listing with the facts enabled in a session.
+type mlsdWriter struct {
+	facts  uint
+	access auth.AccessType
+	bytes.Buffer
+}
+
+func newMLSDWriter(facts uint, access auth.AccessType) *mlsdWriter {
+	return &mlsdWriter{facts: facts, access: access}
+}
+
+// add adds an entry for a file, with type typ if not empty.
+func (o *mlsdWriter) add(file *mount.File, name, typ string) {
+	formatMLSXString(o, file, name, typ, o.facts, o.access)
+	o.WriteString("\r\n")
 }
@@ -1,113 +1,408 @@
 package ftpd
 
 import (
-	"bufio"
-	"bytes"
+	"compress/zlib"
+	"crypto/tls"
 	"io"
 	"log"
 	"net"
+	"strconv"
 	"sync/atomic"
 	"time"
+
+	"github.com/Edgaru089/ftpd/mount"
 )
 
-// If state.pasvConn is nil, state.pasvListener must not be nil. This code panics otherwise.
-func (s *Server) ensureOpenDataConn(sc *bufio.Scanner, state *ctrlState, writer io.WriteCloser) {
-	if state.pasvConn == nil {
-		writeFTPReplySingleline(writer, &s.buffer, 150)
+// ensureOpenDataConn makes sure c.dataConn is connected, accepting on
+// the passive listener or dialing out to the PORT/EPRT target as the
+// current data connection mode requires.
+//
+// It sends the 150/125 preliminary reply and returns the connection,
+// or sends a 425 and returns false on failure.
+func (c *Session) ensureOpenDataConn() (conn net.Conn, ok bool) {
+	s, state := c.server, &c.state
+
+	// The preliminary reply, with custom text if set
+	prelim := func(code int) {
+		if len(c.prelimText) != 0 {
+			c.replyText(code, c.prelimText)
+		} else {
+			c.reply(code)
+		}
+	}
+	defer func() { c.prelimText = "" }()
+
+	c.dataLock.Lock()
+	conn = c.dataConn
+	c.dataLock.Unlock()
+	if conn != nil {
+		prelim(125)
+		return conn, true
+	}
+
+	switch state.dataConnMode {
+	case DataConnPassive:
+		if state.pasvListener == nil {
+			c.reply(425)
+			return nil, false
+		}
+		prelim(150)
 
 		// Listen for the Data Connection for some while
 		state.pasvListener.SetDeadline(time.Now().Add(s.DataConnTimeout))
 		l, err := state.pasvListener.Accept()
+
+		// Close and dispose the listener (???)
+		c.closeDataListener()
+
 		if err != nil {
-			//if op, ok := err.(*net.OpError); ok && op.Timeout()
-			writeFTPReplySingleline(writer, &s.buffer, 426)
-			return
+			log.Print("openDataConn: accept error: ", err)
+			c.reply(425)
+			return nil, false
 		}
+		conn = l
 
-		state.pasvConn = l.(*net.TCPConn)
+	case DataConnActive:
+		if state.activeIP == nil { // No PORT/EPRT yet
+			c.reply(425)
+			return nil, false
+		}
+		prelim(150)
 
-		// Close and dispose the listener (???)
+		dialer := net.Dialer{Timeout: s.DataConnTimeout}
+		if len(s.ActiveDataAddress) != 0 || s.ActiveDataPort != 0 {
+			dialer.LocalAddr = &net.TCPAddr{
+				IP:   net.ParseIP(s.ActiveDataAddress),
+				Port: s.ActiveDataPort,
+			}
+		}
+		var err error
+		conn, err = dialer.Dial("tcp", net.JoinHostPort(state.activeIP.String(), strconv.Itoa(state.activePort)))
+		if err != nil {
+			log.Print("openDataConn: dial error: ", err)
+			c.reply(425)
+			return nil, false
+		}
+	}
+
+	if state.protected {
+		// PROT P: we are always the TLS server side, even in active mode (RFC 4217)
+		tconn := tls.Server(conn, s.TLSConfig)
+		tconn.SetDeadline(time.Now().Add(s.DataConnTimeout))
+		if err := tconn.Handshake(); err != nil {
+			log.Print("openDataConn: TLS handshake error: ", err)
+			conn.Close()
+			c.reply(425)
+			return nil, false
+		}
+		tconn.SetDeadline(time.Time{})
+		conn = tconn
+	}
+
+	c.dataLock.Lock()
+	c.dataConn = conn
+	c.dataLock.Unlock()
+
+	log.Print("openDataConn: connected: ", conn.RemoteAddr())
+	return conn, true
+}
+
+// closeDataConn closes the data connection after a transfer on it.
+func (c *Session) closeDataConn(conn net.Conn) {
+	c.dataLock.Lock()
+	defer c.dataLock.Unlock()
+	conn.Close()
+	if c.dataConn == conn {
+		c.dataConn = nil
+	}
+}
+
+// passiveListenAddr returns the network ("tcp4" or "tcp6") and address to
+// listen on for passive data connections, which is in the same address
+// family as the control connection. DataAddress is used if it is a
+// specific address of that family.
+func (s *Server) passiveListenAddr(writer io.Writer) (network, addr string) {
+	network, addr = "tcp4", s.DataAddress
+
+	conn, ok := writer.(net.Conn)
+	if !ok {
+		return
+	}
+	laddr, ok := conn.LocalAddr().(*net.TCPAddr)
+	if !ok {
+		return
+	}
+
+	ctrl4 := laddr.IP.To4() != nil
+	if !ctrl4 {
+		network = "tcp6"
+	}
+	if ip := net.ParseIP(s.DataAddress); ip == nil || ip.IsUnspecified() || (ip.To4() != nil) != ctrl4 {
+		addr = laddr.IP.String()
+	}
+	return
+}
+
+// passiveAdvertiseIP returns the IP to advertise in a PASV reply to the
+// client on the control connection writer, or nil if there is none.
+func (s *Server) passiveAdvertiseIP(writer io.Writer) net.IP {
+	conn, _ := writer.(net.Conn)
+
+	if s.PassiveAddressFunc != nil && conn != nil {
+		if ip := s.PassiveAddressFunc(conn.RemoteAddr()); ip != nil {
+			return ip
+		}
+	}
+	if len(s.PassiveAddress) != 0 {
+		if ip := s.resolvePassiveAddress(); ip != nil {
+			return ip
+		}
+	}
+	if ip := net.ParseIP(s.DataAddress); ip != nil && !ip.IsUnspecified() {
+		return ip
+	}
+	if conn != nil {
+		if laddr, ok := conn.LocalAddr().(*net.TCPAddr); ok {
+			return laddr.IP
+		}
+	}
+	return nil
+}
+
+// resolvePassiveAddress returns PassiveAddress as an IPv4 address, looking
+// it up again if the last resolution is older than PassiveResolveInterval.
+// The last good result is kept if the lookup fails, and returned to other
+// sessions while the lookup runs.
+func (s *Server) resolvePassiveAddress() net.IP {
+	if ip := net.ParseIP(s.PassiveAddress); ip != nil {
+		return ip
+	}
+
+	s.pasvLock.Lock()
+	if s.pasvIP != nil && (s.pasvResolving || time.Since(s.pasvResolved) < s.PassiveResolveInterval) {
+		ip := s.pasvIP
+		s.pasvLock.Unlock()
+		return ip
+	}
+	s.pasvResolving = true
+	s.pasvLock.Unlock()
+
+	ips, err := net.LookupIP(s.PassiveAddress)
+
+	s.pasvLock.Lock()
+	defer s.pasvLock.Unlock()
+	s.pasvResolving = false
+	if err != nil {
+		log.Print("resolvePassiveAddress: lookup error: ", err)
+		return s.pasvIP
+	}
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			s.pasvIP = ip
+			s.pasvResolved = time.Now()
+			break
+		}
+	}
+	return s.pasvIP
+}
+
+// listenPassive allocates a data port and starts the passive listener on
+// it, setting the data connection mode to passive.
+//
+// It returns the listening port, or sends 425 and returns false on failure.
+func (c *Session) listenPassive() (port int, ok bool) {
+	s, state := c.server, &c.state
+	network, addr := s.passiveListenAddr(c.conn)
+
+	dport := s.alloPort()
+	if dport == 0 {
+		c.reply(425)
+		return 0, false
+	}
+
+	l, err := net.Listen(network, net.JoinHostPort(addr, strconv.Itoa(dport)))
+	if err != nil {
+		s.freePort(dport)
+		c.reply(425)
+		log.Print("listenPassive: listen error: ", err)
+		return 0, false
+	}
+
+	state.pasvPort = dport
+	state.pasvListener = l.(*net.TCPListener)
+	state.dataConnMode = DataConnPassive
+	return dport, true
+}
+
+// closeDataListener closes the passive listener, if any, and frees its port.
+func (c *Session) closeDataListener() {
+	state := &c.state
+	if state.pasvListener != nil {
 		state.pasvListener.Close()
 		state.pasvListener = nil
-		s.freePort(state.pasvPort)
-
-	} else {
-		writeFTPReplySingleline(writer, &s.buffer, 125)
+		c.server.freePort(state.pasvPort)
 	}
-	log.Print("openDataConn: connected: ", state.pasvConn.RemoteAddr())
 }
 
 // It closes from.
-// If state.pasvConn is nil, state.pasvListener must not be nil. This code panics otherwise.
-func (s *Server) writeToDataConn(from io.Reader, sc *bufio.Scanner, state *ctrlState, writer io.WriteCloser) {
-	s.ensureOpenDataConn(sc, state, writer)
-	if state.pasvConn == nil {
-		writer.Close()
-	}
-
-	// We now have a stable data connection, state.pasvConn, to write to.
-	log.Print("writeDataConn: starting transfer: ", state.pasvConn.RemoteAddr())
-	atomic.StoreInt32(&state.transferError, 0)
-	atomic.StoreInt32(&state.inTransfer, 1)
-	asbuf := &bytes.Buffer{}
+func (c *Session) writeToDataConn(from io.Reader) {
+	conn, ok := c.ensureOpenDataConn()
+	if !ok {
+		if closer, ok := from.(io.Closer); ok {
+			closer.Close()
+		}
+		return
+	}
+
+	// We now have a stable data connection to write to.
+	log.Print("writeDataConn: starting transfer: ", conn.RemoteAddr())
+	c.transferCmd = c.line
+	atomic.StoreInt64(&c.transferBytes, 0)
+	atomic.StoreInt32(&c.transferError, 0)
+	atomic.StoreInt32(&c.inTransfer, 1)
+
+	src := from
+	var interval int64 = blockMarkerInterval
+	if c.state.datatype == DataASCII {
+		src = newCRLFReader(from)
+		interval = 0 // Markers would not be file offsets
+	}
+	offset := c.transferOffset
+	c.transferOffset = 0
+	mode, level := c.state.datamode, c.state.zlevel
 	go func() {
-		_, err := io.Copy(state.pasvConn, from)
-		if (err == nil || err == io.EOF) && atomic.LoadInt32(&state.transferError) == 0 {
-			// Completed without much error, send the okay message
-			writeFTPReplySingleline(writer, asbuf, 226)
-		} else {
-			log.Print("writeDataConn: error: ", err)
-			writeFTPReplySingleline(writer, asbuf, 426)
+		var dst io.Writer = conn
+		var zw *zlib.Writer
+		var bw *blockWriter
+		switch mode {
+		case DataDeflate:
+			zw, _ = zlib.NewWriterLevel(conn, level) // level checked by OPTS
+			dst = zw
+		case DataBlock:
+			bw = newBlockWriter(conn, offset, interval)
+			dst = bw
 		}
 
-		raddr := state.pasvConn.RemoteAddr().String()
+		_, err := io.Copy(countWriter{dst, &c.transferBytes}, src)
+		if zw != nil {
+			if cerr := zw.Close(); err == nil {
+				err = cerr
+			}
+		}
+		if bw != nil && err == nil {
+			// Only a complete transfer ends with the EOF block
+			err = bw.Close()
+		}
 
-		// There should be no race condition here
-		state.pasvConn.Close()
-		state.pasvConn = nil
+		// Close the data connection before replying, so that the next
+		// command from the client never sees it still open.
+		c.closeDataConn(conn)
 
 		if closer, ok := from.(io.Closer); ok {
 			closer.Close()
 		}
 
-		log.Print("writeDataConn: ended transfer: ", raddr)
+		log.Print("writeDataConn: ended transfer: ", conn.RemoteAddr())
+
+		if (err == nil || err == io.EOF) && atomic.LoadInt32(&c.transferError) == 0 {
+			// Completed without much error, send the okay message
+			c.reply(226)
+		} else {
+			log.Print("writeDataConn: error: ", err)
+			c.reply(426)
+		}
 
-		atomic.StoreInt32(&state.inTransfer, 0)
+		atomic.StoreInt32(&c.inTransfer, 0)
+		if c.server.shuttingDown() {
+			c.closeShutdown()
+		}
 	}()
 }
 
 // It closes to.
-// If state.pasvConn is nil, state.pasvListener must not be nil. This code panics otherwise.
 // This function is copied from above(writeToDataConn) so keep them in sync please.
-func (s *Server) readFromDataConn(to io.Writer, sc *bufio.Scanner, state *ctrlState, writer io.WriteCloser) {
-	s.ensureOpenDataConn(sc, state, writer)
-
-	// We now have a stable data connection, state.pasvConn, to write to.
-	log.Print("readDataConn: starting transfer: ", state.pasvConn.RemoteAddr())
-	atomic.StoreInt32(&state.transferError, 0)
-	atomic.StoreInt32(&state.inTransfer, 1)
-	asbuf := &bytes.Buffer{}
+func (c *Session) readFromDataConn(to io.Writer) {
+	created, node := c.transferCreated, c.state.root
+	c.transferCreated = ""
+
+	conn, ok := c.ensureOpenDataConn()
+	if !ok {
+		if closer, ok := to.(io.Closer); ok {
+			closer.Close()
+		}
+		if len(created) != 0 {
+			node.DeleteFile(created)
+		}
+		return
+	}
+
+	// We now have a stable data connection to read from.
+	log.Print("readDataConn: starting transfer: ", conn.RemoteAddr())
+	c.transferCmd = c.line
+	atomic.StoreInt64(&c.transferBytes, 0)
+	atomic.StoreInt32(&c.transferError, 0)
+	atomic.StoreInt32(&c.inTransfer, 1)
+
+	var ascii *lfWriter
+	var written int64 // Bytes written to the file, for block mode restart markers
+	dst := io.Writer(countWriter{to, &written})
+	if c.state.datatype == DataASCII {
+		ascii = newLFWriter(dst)
+		dst = ascii
+	}
+	offset := c.transferOffset
+	c.transferOffset = 0
+	mode := c.state.datamode
 	go func() {
-		_, err := io.Copy(to, state.pasvConn)
-		if (err == nil || err == io.EOF) && atomic.LoadInt32(&state.transferError) == 0 {
-			// Completed without much error, send the okay message
-			writeFTPReplySingleline(writer, asbuf, 226)
-		} else {
-			log.Print("readDataConn: error: ", err)
-			writeFTPReplySingleline(writer, asbuf, 426)
+		var src io.Reader = conn
+		var err error
+		switch mode {
+		case DataDeflate:
+			// This reads the zlib header, so it is in the goroutine
+			src, err = zlib.NewReader(conn)
+		case DataBlock:
+			// Reply with the file offset the sender can restart from
+			src = newBlockReader(conn, func(marker string) {
+				c.reply(110, marker, strconv.FormatInt(offset+written, 10))
+			})
 		}
 
-		log.Print("readDataConn: ending transfer: ", state.pasvConn.RemoteAddr())
+		if err == nil {
+			_, err = io.Copy(countWriter{dst, &c.transferBytes}, src)
+		}
+		if ascii != nil && err == nil {
+			err = ascii.Flush()
+		}
 
-		// There should be no race condition here
-		state.pasvConn.Close()
-		state.pasvConn = nil
+		log.Print("readDataConn: ending transfer: ", conn.RemoteAddr())
+
+		// Close the data connection (and the file) before replying.
+		c.closeDataConn(conn)
 
 		if closer, ok := to.(io.Closer); ok {
 			closer.Close()
 		}
 
-		atomic.StoreInt32(&state.inTransfer, 0)
-	}()
+		success := (err == nil || err == io.EOF) && atomic.LoadInt32(&c.transferError) == 0
+		if !success && written == 0 && len(created) != 0 {
+			// Do not leave an empty file behind
+			node.DeleteFile(created)
+		}
 
+		if success {
+			// Completed without much error, send the okay message
+			c.reply(226)
+		} else if err == mount.ErrNoSpace {
+			log.Print("readDataConn: error: ", err)
+			c.reply(552)
+		} else {
+			log.Print("readDataConn: error: ", err)
+			c.reply(426)
+		}
+
+		atomic.StoreInt32(&c.inTransfer, 0)
+		if c.server.shuttingDown() {
+			c.closeShutdown()
+		}
+	}()
 }
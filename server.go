@@ -1,12 +1,14 @@
 package ftpd
 
 import (
-	"bytes"
+	"context"
+	"crypto/tls"
 	"errors"
 	"log"
 	"net"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/Edgaru089/ftpd/auth"
@@ -27,26 +29,78 @@ type Server struct {
 	// Listen address for data connections in passive mode, defaults to "0.0.0.0".
 	DataAddress string
 
+	// PassiveAddress is the externally reachable address advertised in PASV
+	// replies, for servers behind NAT or a load balancer. It is an IPv4
+	// address or a hostname, resolved again every PassiveResolveInterval.
+	// If empty, DataAddress is advertised, or the address the control
+	// connection was accepted on if DataAddress is "0.0.0.0".
+	PassiveAddress string
+	// Interval for resolving a PassiveAddress hostname, defaults to 1 minute.
+	PassiveResolveInterval time.Duration
+	// PassiveAddressFunc, if not nil, returns the address to advertise in
+	// the PASV reply to the client at remote, taking precedence over
+	// PassiveAddress. It falls back to the latter by returning nil.
+	// It is called from multiple goroutines.
+	PassiveAddressFunc func(remote net.Addr) net.IP
+
+	// Local address and port active mode data connections are dialed from.
+	// Both default to empty, letting the system choose. Set ActiveDataPort
+	// to 20 to use the traditional ftp-data source port.
+	ActiveDataAddress string
+	ActiveDataPort    int
+
 	// Root filesystem node. Should not be changed after server start.
 	Node mount.Node
 
 	// Simple authenticator. If nil, it defaults to auth.Anonymous.
+	// If it implements auth.Root, users get their own filesystem roots.
 	Auth auth.Auth
 
-	// Timeout for a passive data connection to wait for. If nil, it defaults
-	// to 3s.
+	// TLS configuration for explicit FTPS (RFC 4217, AUTH TLS). If nil,
+	// AUTH is refused and FTP over TLS is not advertised.
+	TLSConfig *tls.Config
+	// TLSRequired refuses USER/PASS on control connections not
+	// protected by TLS. Requires TLSConfig.
+	TLSRequired bool
+	// ImplicitTLSPort is the control listening port for implicit FTPS,
+	// usually 990, on which connections are protected by TLS from the
+	// start, data connections included. 0 (default) disables it.
+	// Requires TLSConfig.
+	ImplicitTLSPort int
+
+	// Number of file checksums cached for HASH and the X* checksum
+	// commands, which stay valid as long as the size and the modification
+	// time of the file do not change. 0 (default) disables the cache.
+	HashCacheSize int
+
+	// Timeout for a passive data connection to wait for, or an active one
+	// to be dialed. If nil, it defaults to 3s.
 	DataConnTimeout time.Duration
 
-	listener *net.TCPListener // control listener
+	listener         *net.TCPListener // control listener
+	implicitListener *net.TCPListener // implicit FTPS control listener, nil if none
 	// for closing the listener, atomic only!!
-	close chan struct{}
+	close     chan struct{}
+	closeOnce sync.Once
+
+	// Set to 1 on Shutdown, atomic only!!
+	shutdown int32
+	// Active control sessions
+	sessions map[*Session]struct{}
+	slock    sync.Mutex
 
 	// Avaliable data ports
 	dports map[int]struct{}
 	dplock sync.Mutex
 
-	// An internal buffer, reused on every command.
-	buffer bytes.Buffer
+	// Cached file checksums
+	hashCache hashCache
+
+	// Resolved PassiveAddress and the time of the resolution
+	pasvIP        net.IP
+	pasvResolved  time.Time
+	pasvResolving bool // A lookup is running, without holding pasvLock
+	pasvLock      sync.Mutex
 }
 
 // Start starts a FTP server.
@@ -55,6 +109,9 @@ func (s *Server) Start() error {
 	if s.MinDataPort > s.MaxDataPort {
 		return errors.New("Start: MinDataPort/MaxDataPort not a valid section")
 	}
+	if (s.TLSRequired || s.ImplicitTLSPort != 0) && s.TLSConfig == nil {
+		return errors.New("Start: TLSRequired or ImplicitTLSPort set without TLSConfig")
+	}
 
 	if s.Port == 0 {
 		s.Port = 21
@@ -75,6 +132,9 @@ func (s *Server) Start() error {
 	if s.DataConnTimeout == 0 {
 		s.DataConnTimeout = time.Second * 3
 	}
+	if s.PassiveResolveInterval == 0 {
+		s.PassiveResolveInterval = time.Minute
+	}
 
 	laddr, err := net.ResolveTCPAddr("tcp", net.JoinHostPort(s.Address, strconv.Itoa(s.Port)))
 	if err != nil {
@@ -85,6 +145,20 @@ func (s *Server) Start() error {
 		return errors.New("ftpd.Server.Start: TCP listen error: " + err.Error())
 	}
 
+	if s.ImplicitTLSPort != 0 {
+		laddr, err := net.ResolveTCPAddr("tcp", net.JoinHostPort(s.Address, strconv.Itoa(s.ImplicitTLSPort)))
+		if err != nil {
+			s.listener.Close()
+			return errors.New("ftpd.Server.Start: TCPAddr resolve error: " + err.Error())
+		}
+		s.implicitListener, err = net.ListenTCP("tcp", laddr)
+		if err != nil {
+			s.listener.Close()
+			return errors.New("ftpd.Server.Start: TCP listen error: " + err.Error())
+		}
+		log.Printf("ftpd: listening on implicit TLS ctrl %s", net.JoinHostPort(s.Address, strconv.Itoa(s.ImplicitTLSPort)))
+	}
+
 	s.dports = make(map[int]struct{})
 	for i := s.MinDataPort; i <= s.MaxDataPort; i++ {
 		s.dports[i] = struct{}{}
@@ -92,8 +166,12 @@ func (s *Server) Start() error {
 
 	log.Printf("ftpd: listening on ctrl %s, data [%s]:[%d-%d]", net.JoinHostPort(s.Address, strconv.Itoa(s.Port)), s.DataAddress, s.MinDataPort, s.MaxDataPort)
 
+	s.sessions = make(map[*Session]struct{})
 	s.close = make(chan struct{})
-	go s.goListen()
+	go s.goListen(s.listener, false)
+	if s.implicitListener != nil {
+		go s.goListen(s.implicitListener, true)
+	}
 
 	return nil
 }
@@ -115,26 +193,97 @@ func (s *Server) freePort(port int) {
 	s.dports[port] = struct{}{}
 }
 
-func (s *Server) goListen() {
+// goListen accepts control connections on listener. If implicitTLS is set,
+// each connection is wrapped in TLS before anything is sent.
+func (s *Server) goListen(listener *net.TCPListener, implicitTLS bool) {
 infiloop:
 	for {
-		conn, err := s.listener.AcceptTCP()
+		conn, err := listener.AcceptTCP()
 		if err != nil {
 			select {
 			case <-s.close: // Closed
 				break infiloop
 			default: // Some random error, log it
 				log.Println("ftpd.Listener: listen error:", err)
+				continue
 			}
 		}
 
 		log.Print("ftpd.Listener: connected: ", conn.RemoteAddr().String())
 		// try sending it!
-		go s.goCtrlConn(conn)
+		var c *Session
+		if implicitTLS {
+			c = newSession(s, tls.Server(conn, s.TLSConfig))
+		} else {
+			c = newSession(s, conn)
+		}
+		s.slock.Lock()
+		s.sessions[c] = struct{}{}
+		s.slock.Unlock()
+		go c.serve()
 	}
 }
 
+// removeSession is called by a session when it ends.
+func (s *Server) removeSession(c *Session) {
+	s.slock.Lock()
+	defer s.slock.Unlock()
+	delete(s.sessions, c)
+}
+
+// Stop stops accepting new connections. Existing sessions are left running.
 func (s *Server) Stop() {
-	close(s.close)
-	s.listener.Close()
+	s.closeOnce.Do(func() {
+		close(s.close)
+		s.listener.Close()
+		if s.implicitListener != nil {
+			s.implicitListener.Close()
+		}
+	})
+}
+
+// Shutdown gracefully shuts down the server. It stops accepting new
+// connections, closes idle sessions with a 421 reply, and waits for
+// sessions in a RETR/STOR transfer to be closed the same way as soon as
+// the transfer completes.
+//
+// If ctx expires first, the remaining sessions are forcibly closed, and
+// the context error is returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	atomic.StoreInt32(&s.shutdown, 1)
+	s.Stop()
+
+	s.slock.Lock()
+	for c := range s.sessions {
+		if atomic.LoadInt32(&c.inTransfer) == 0 {
+			c.closeShutdown()
+		}
+	}
+	s.slock.Unlock()
+
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		s.slock.Lock()
+		left := len(s.sessions)
+		s.slock.Unlock()
+		if left == 0 {
+			return nil
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			s.slock.Lock()
+			for c := range s.sessions {
+				c.forceClose()
+			}
+			s.slock.Unlock()
+			return ctx.Err()
+		}
+	}
+}
+
+func (s *Server) shuttingDown() bool {
+	return atomic.LoadInt32(&s.shutdown) != 0
 }
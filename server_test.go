@@ -0,0 +1,1379 @@
+package ftpd
+
+import (
+	"bytes"
+	"compress/zlib"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"net/textproto"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Edgaru089/ftpd/auth"
+	"github.com/Edgaru089/ftpd/mount"
+)
+
+// putFile stores a file with the content on node.
+func putFile(t testing.TB, node *mount.NodeMemory, file, content string) {
+	w, err := node.WriteFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(w, content)
+}
+
+// fileContent returns the content of a file on node, and false if it does
+// not exist.
+func fileContent(node *mount.NodeMemory, file string) (string, bool) {
+	r, err := node.ReadFile(file)
+	if err != nil {
+		return "", false
+	}
+	data, _ := ioutil.ReadAll(r)
+	return string(data), true
+}
+
+// freePort returns a local port that is free to listen on.
+func freePort(t testing.TB) int {
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+// startTestServer starts a server on a random local port, serving node.
+// The configure functions are called on the server before it starts.
+func startTestServer(t testing.TB, node mount.Node, configure ...func(s *Server)) (s *Server, addr string) {
+	log.SetOutput(ioutil.Discard)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	port := freePort(t)
+	s = &Server{
+		Port:        port,
+		Address:     "127.0.0.1",
+		DataAddress: "127.0.0.1",
+		Node:        node,
+		Auth:        &auth.SingleAccount{Username: "user", Password: "pass"},
+	}
+	for _, f := range configure {
+		f(s)
+	}
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.Stop)
+	return s, net.JoinHostPort("127.0.0.1", strconv.Itoa(port))
+}
+
+// testClient is a simple FTP client for the tests.
+type testClient struct {
+	*textproto.Conn
+	conn net.Conn
+	t    testing.TB
+
+	// Config for protected data connections after PROT P, nil if clear
+	dataTLS *tls.Config
+
+	// The client runs on a goroutine other than the test one, so it
+	// must not call t.Fatal.
+	async bool
+}
+
+func dialTestClient(t testing.TB, addr string, async bool) *testClient {
+	c := &testClient{t: t, async: async}
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		c.fatalf("dial error: %s", err)
+	}
+	c.conn, c.Conn = conn, textproto.NewConn(conn)
+	c.expect(220)
+	return c
+}
+
+// startTLS runs the client side TLS handshake on the control connection,
+// after AUTH TLS or right after dialing the implicit FTPS port.
+func (c *testClient) startTLS(config *tls.Config) {
+	c.t.Helper()
+	tconn := tls.Client(c.conn, config)
+	if err := tconn.Handshake(); err != nil {
+		c.fatalf("TLS handshake error: %s", err)
+	}
+	c.conn, c.Conn = tconn, textproto.NewConn(tconn)
+}
+
+func (c *testClient) fatalf(format string, args ...interface{}) {
+	c.t.Helper()
+	if c.async {
+		c.t.Errorf(format, args...)
+		runtime.Goexit()
+	}
+	c.t.Fatalf(format, args...)
+}
+
+// cmd sends a command and checks the reply code, returning the reply message.
+func (c *testClient) cmd(code int, format string, args ...interface{}) string {
+	c.t.Helper()
+	if _, err := c.Cmd("%s", strings.TrimSpace(fmt.Sprintf(format, args...))); err != nil {
+		c.fatalf("command error: %s", err)
+	}
+	return c.expect(code)
+}
+
+func (c *testClient) expect(code int) string {
+	c.t.Helper()
+	gotcode, msg, err := c.ReadResponse(code)
+	if err != nil {
+		c.fatalf("expecting %d, got %d %s (%s)", code, gotcode, msg, err)
+	}
+	return msg
+}
+
+func (c *testClient) login() {
+	c.t.Helper()
+	c.cmd(331, "USER user")
+	c.cmd(230, "PASS pass")
+	c.cmd(200, "TYPE I")
+}
+
+// epsv sends EPSV and dials the data connection.
+func (c *testClient) epsv() net.Conn {
+	c.t.Helper()
+	msg := c.cmd(229, "EPSV")
+	msg = msg[strings.Index(msg, "|||")+3:]
+	port, err := strconv.Atoi(msg[:strings.IndexByte(msg, '|')])
+	if err != nil {
+		c.fatalf("bad EPSV reply: %s", err)
+	}
+	conn, err := net.DialTimeout("tcp4", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)), time.Second)
+	if err != nil {
+		c.fatalf("data dial error: %s", err)
+	}
+	if c.dataTLS != nil {
+		// The handshake runs on first use, after the server sends 150
+		return tls.Client(conn, c.dataTLS)
+	}
+	return conn
+}
+
+func (c *testClient) store(name string, data []byte) {
+	c.t.Helper()
+	conn := c.epsv()
+	c.cmd(150, "STOR %s", name)
+	conn.Write(data)
+	conn.Close()
+	c.expect(226)
+}
+
+func (c *testClient) retrieve(name string) []byte {
+	c.t.Helper()
+	conn := c.epsv()
+	c.cmd(150, "RETR %s", name)
+	data, err := ioutil.ReadAll(conn)
+	conn.Close()
+	if err != nil {
+		c.fatalf("data read error: %s", err)
+	}
+	c.expect(226)
+	return data
+}
+
+// list sends a listing command, like "LIST -a dir", returning the listing.
+func (c *testClient) list(cmd string) string {
+	c.t.Helper()
+	conn := c.epsv()
+	c.cmd(150, "%s", cmd)
+	data, err := ioutil.ReadAll(conn)
+	conn.Close()
+	if err != nil {
+		c.fatalf("data read error: %s", err)
+	}
+	c.expect(226)
+	return string(data)
+}
+
+func TestSessionTransfer(t *testing.T) {
+	_, addr := startTestServer(t, &mount.NodeMemory{})
+
+	c := dialTestClient(t, addr, false)
+	defer c.Close()
+	c.login()
+
+	data := []byte("Hello, FTP!\r\nSecond line\n")
+	c.store("hello.txt", data)
+	if got := c.retrieve("hello.txt"); !bytes.Equal(got, data) {
+		t.Errorf("RETR got %q, want %q", got, data)
+	}
+	if got := c.cmd(213, "SIZE hello.txt"); got != strconv.Itoa(len(data)) {
+		t.Errorf("SIZE got %s, want %d", got, len(data))
+	}
+	c.cmd(550, "RETR missing.txt")
+	c.cmd(221, "QUIT")
+}
+
+func TestSessionConcurrent(t *testing.T) {
+	_, addr := startTestServer(t, &mount.NodeMemory{})
+
+	const clients = 40
+	var wg sync.WaitGroup
+	for i := 0; i < clients; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			c := dialTestClient(t, addr, true)
+			defer c.Close()
+			c.login()
+
+			name := fmt.Sprintf("file%d.txt", i)
+			dir := fmt.Sprintf("dir%d", i)
+			data := bytes.Repeat([]byte(name+"\r\n"), 1000+i)
+
+			c.cmd(200, "MKD %s", dir)
+			c.cmd(200, "CWD %s", dir)
+			for j := 0; j < 5; j++ {
+				if got := c.cmd(257, "PWD"); got != `"/`+dir+`" created.` {
+					t.Errorf("client %d: PWD got %s", i, got)
+				}
+				c.cmd(200, "TYPE I")
+			}
+			c.store(name, data)
+			if got := c.retrieve(name); !bytes.Equal(got, data) {
+				t.Errorf("client %d: RETR got %d bytes, want %d", i, len(got), len(data))
+			}
+			c.cmd(213, "SIZE %s", name)
+			c.cmd(221, "QUIT")
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestShutdown(t *testing.T) {
+	s, addr := startTestServer(t, &mount.NodeMemory{})
+
+	idle := dialTestClient(t, addr, false)
+	defer idle.Close()
+	idle.login()
+
+	busy := dialTestClient(t, addr, false)
+	defer busy.Close()
+	busy.login()
+	conn := busy.epsv()
+	busy.cmd(150, "STOR upload.txt")
+	conn.Write([]byte("first half\n"))
+
+	done := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		done <- s.Shutdown(ctx)
+	}()
+
+	// The idle session is closed right away
+	idle.expect(421)
+
+	// The running transfer completes before its session is closed
+	conn.Write([]byte("second half\n"))
+	conn.Close()
+	busy.expect(226)
+	busy.expect(421)
+
+	if err := <-done; err != nil {
+		t.Errorf("Shutdown error: %s", err)
+	}
+	if stat, err := s.Node.Stat("upload.txt"); err != nil || stat.Size != 23 {
+		t.Errorf("uploaded file stat %v, error %v", stat, err)
+	}
+}
+
+func TestActiveMode(t *testing.T) {
+	node := &mount.NodeMemory{}
+	putFile(t, node, "file.txt", "active content")
+	_, addr := startTestServer(t, node)
+
+	c := dialTestClient(t, addr, false)
+	defer c.Close()
+	c.login()
+
+	l, err := net.ListenTCP("tcp4", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	port := l.Addr().(*net.TCPAddr).Port
+
+	// accept returns the data connection dialed by the server
+	accept := func() net.Conn {
+		t.Helper()
+		l.SetDeadline(time.Now().Add(time.Second))
+		conn, err := l.Accept()
+		if err != nil {
+			t.Fatalf("data accept error: %s", err)
+		}
+		return conn
+	}
+
+	c.cmd(200, "PORT 127,0,0,1,%d,%d", port>>8, port&0xff)
+	c.cmd(150, "RETR file.txt")
+	conn := accept()
+	data, _ := ioutil.ReadAll(conn)
+	conn.Close()
+	c.expect(226)
+	if string(data) != "active content" {
+		t.Errorf("RETR got %q", data)
+	}
+
+	c.cmd(200, "EPRT |1|127.0.0.1|%d|", port)
+	c.cmd(150, "STOR upload.txt")
+	conn = accept()
+	conn.Write([]byte("uploaded"))
+	conn.Close()
+	c.expect(226)
+	if got, _ := fileContent(node, "upload.txt"); got != "uploaded" {
+		t.Errorf("STOR got %q", got)
+	}
+
+	// The target must be the client itself, on an unprivileged port
+	c.cmd(504, "PORT 10,0,0,1,%d,%d", port>>8, port&0xff)
+	c.cmd(504, "EPRT |1|10.0.0.1|%d|", port)
+	c.cmd(504, "PORT 127,0,0,1,0,21")
+	c.cmd(504, "EPRT |1|127.0.0.1|21|")
+	c.cmd(501, "PORT 127,0,0,1")
+	c.cmd(501, "EPRT |1|127.0.0.1|0|")
+}
+
+func TestExtendedPassive(t *testing.T) {
+	_, addr := startTestServer(t, &mount.NodeMemory{})
+
+	c := dialTestClient(t, addr, false)
+	defer c.Close()
+	c.login()
+
+	// The control connection is IPv4, so is the data connection
+	c.cmd(229, "EPSV 1")
+	if msg := c.cmd(522, "EPSV 2"); !strings.Contains(msg, "(1)") {
+		t.Errorf("EPSV 2 got %q", msg)
+	}
+	c.cmd(522, "EPSV 3")
+	c.cmd(522, "EPRT |3|127.0.0.1|2000|")
+	c.cmd(501, "EPRT |2|127.0.0.1|2000|")
+	c.cmd(504, "EPRT |2|::1|2000|")
+
+	// After EPSV ALL, EPSV is the only way to set up a data connection
+	c.cmd(200, "EPSV ALL")
+	c.cmd(503, "PORT 127,0,0,1,7,208")
+	c.cmd(503, "EPRT |1|127.0.0.1|2000|")
+	c.cmd(503, "PASV")
+	c.store("file.txt", []byte("data"))
+	c.cmd(503, "PASV")
+
+	// Over IPv6
+	l, err := net.Listen("tcp6", "[::1]:0")
+	if err != nil {
+		t.Skip("no IPv6 loopback: ", err)
+	}
+	l.Close()
+	s6, _ := startTestServer(t, &mount.NodeMemory{}, func(s *Server) {
+		s.Address, s.DataAddress = "::1", "::1"
+	})
+	c6 := dialTestClient(t, net.JoinHostPort("::1", strconv.Itoa(s6.Port)), false)
+	defer c6.Close()
+	c6.login()
+
+	if msg := c6.cmd(522, "EPSV 1"); !strings.Contains(msg, "(2)") {
+		t.Errorf("EPSV 1 got %q", msg)
+	}
+	msg := c6.cmd(229, "EPSV 2")
+	msg = msg[strings.Index(msg, "|||")+3:]
+	conn, err := net.DialTimeout("tcp6", net.JoinHostPort("::1", msg[:strings.IndexByte(msg, '|')]), time.Second)
+	if err != nil {
+		t.Fatalf("data dial error: %s", err)
+	}
+	c6.cmd(150, "STOR file.txt")
+	conn.Write([]byte("data"))
+	conn.Close()
+	c6.expect(226)
+	c6.cmd(425, "PASV")
+
+	// EPRT to the IPv6 client
+	l6, err := net.ListenTCP("tcp6", &net.TCPAddr{IP: net.IPv6loopback})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l6.Close()
+	c6.cmd(200, "EPRT |2|::1|%d|", l6.Addr().(*net.TCPAddr).Port)
+	c6.cmd(150, "RETR file.txt")
+	l6.SetDeadline(time.Now().Add(time.Second))
+	conn, err = l6.Accept()
+	if err != nil {
+		t.Fatalf("data accept error: %s", err)
+	}
+	data, _ := ioutil.ReadAll(conn)
+	conn.Close()
+	c6.expect(226)
+	if string(data) != "data" {
+		t.Errorf("RETR over EPRT |2| got %q", data)
+	}
+}
+
+func TestPassiveAddress(t *testing.T) {
+	pasv := func(configure func(s *Server)) string {
+		t.Helper()
+		_, addr := startTestServer(t, &mount.NodeMemory{}, configure)
+		c := dialTestClient(t, addr, false)
+		defer c.Close()
+		c.login()
+		return c.cmd(227, "PASV")
+	}
+
+	if msg := pasv(func(s *Server) {}); !strings.Contains(msg, "(127,0,0,1,") {
+		t.Errorf("PASV got %q", msg)
+	}
+	if msg := pasv(func(s *Server) { s.PassiveAddress = "10.1.2.3" }); !strings.Contains(msg, "(10,1,2,3,") {
+		t.Errorf("PASV with PassiveAddress got %q", msg)
+	}
+
+	// PassiveAddressFunc takes precedence, falling back to PassiveAddress on nil
+	remotes := make(chan net.Addr, 1)
+	msg := pasv(func(s *Server) {
+		s.PassiveAddress = "10.1.2.3"
+		s.PassiveAddressFunc = func(addr net.Addr) net.IP {
+			remotes <- addr
+			return net.IPv4(10, 9, 8, 7)
+		}
+	})
+	if !strings.Contains(msg, "(10,9,8,7,") {
+		t.Errorf("PASV with PassiveAddressFunc got %q", msg)
+	}
+	if remote := <-remotes; !remote.(*net.TCPAddr).IP.IsLoopback() {
+		t.Errorf("PassiveAddressFunc called with %s", remote)
+	}
+	msg = pasv(func(s *Server) {
+		s.PassiveAddress = "10.1.2.3"
+		s.PassiveAddressFunc = func(net.Addr) net.IP { return nil }
+	})
+	if !strings.Contains(msg, "(10,1,2,3,") {
+		t.Errorf("PASV with PassiveAddressFunc returning nil got %q", msg)
+	}
+}
+
+func TestResolvePassiveAddress(t *testing.T) {
+	s := &Server{PassiveAddress: "localhost", PassiveResolveInterval: time.Hour}
+	if ip := s.resolvePassiveAddress(); !ip.IsLoopback() {
+		t.Fatalf("localhost resolved to %s", ip)
+	}
+
+	// Cached until PassiveResolveInterval passes
+	cached := net.IPv4(10, 1, 2, 3)
+	s.pasvIP = cached
+	if ip := s.resolvePassiveAddress(); !ip.Equal(cached) {
+		t.Errorf("got %s, want the cached one", ip)
+	}
+
+	// Expired, but another session is looking it up
+	s.pasvResolved = time.Time{}
+	s.pasvResolving = true
+	if ip := s.resolvePassiveAddress(); !ip.Equal(cached) {
+		t.Errorf("got %s during a lookup, want the cached one", ip)
+	}
+	s.pasvResolving = false
+	if ip := s.resolvePassiveAddress(); !ip.IsLoopback() {
+		t.Errorf("got %s after expiring", ip)
+	}
+}
+
+func TestRestart(t *testing.T) {
+	_, addr := startTestServer(t, &mount.NodeMemory{})
+
+	c := dialTestClient(t, addr, false)
+	defer c.Close()
+	c.login()
+
+	c.store("rest.txt", []byte("0123456789"))
+
+	c.cmd(350, "REST 4")
+	if got := string(c.retrieve("rest.txt")); got != "456789" {
+		t.Errorf("RETR after REST 4 got %q", got)
+	}
+	// The marker is used only once
+	if got := string(c.retrieve("rest.txt")); got != "0123456789" {
+		t.Errorf("RETR got %q", got)
+	}
+
+	c.cmd(350, "REST 10")
+	c.store("rest.txt", []byte("abc"))
+	if got := string(c.retrieve("rest.txt")); got != "0123456789abc" {
+		t.Errorf("RETR after resumed STOR got %q", got)
+	}
+
+	c.cmd(501, "REST -1")
+	c.cmd(350, "REST 20")
+	c.cmd(554, "RETR rest.txt")
+}
+
+func TestNameList(t *testing.T) {
+	_, addr := startTestServer(t, &mount.NodeMemory{})
+
+	c := dialTestClient(t, addr, false)
+	defer c.Close()
+	c.login()
+
+	c.cmd(200, "MKD sub")
+	c.store("a.csv", nil)
+	c.store("b.txt", nil)
+	c.store("sub/c.csv", nil)
+
+	for _, tc := range []struct{ arg, want string }{
+		{"", "a.csv\r\nb.txt\r\nsub\r\n"},
+		{"*.csv", "a.csv\r\n"},
+		{"sub", "sub/c.csv\r\n"},
+		{"sub/*.csv", "sub/c.csv\r\n"},
+		{"b.txt", "b.txt\r\n"},
+	} {
+		if got := c.list("NLST " + tc.arg); got != tc.want {
+			t.Errorf("NLST %s got %q, want %q", tc.arg, got, tc.want)
+		}
+	}
+
+	c.cmd(450, "NLST *.doc")
+	c.cmd(550, "NLST missing")
+}
+
+func TestStatus(t *testing.T) {
+	_, addr := startTestServer(t, &mount.NodeMemory{})
+
+	c := dialTestClient(t, addr, false)
+	defer c.Close()
+	c.cmd(211, "STAT")
+	c.login()
+
+	c.cmd(200, "MKD sub")
+	c.store("sub/a.txt", []byte("hello"))
+
+	if got := c.cmd(211, "STAT"); !strings.Contains(got, "Logged in as user") || !strings.Contains(got, "No transfer in progress") {
+		t.Errorf("STAT got %q", got)
+	}
+	if got := c.cmd(212, "STAT sub"); !strings.Contains(got, "a.txt") {
+		t.Errorf("STAT sub got %q", got)
+	}
+	if got := c.cmd(213, "STAT sub/a.txt"); !strings.Contains(got, " 5 ") || !strings.HasSuffix(strings.Split(got, "\n")[1], "a.txt") {
+		t.Errorf("STAT sub/a.txt got %q", got)
+	}
+	c.cmd(550, "STAT missing")
+
+	// STAT during a transfer reports its progress
+	conn := c.epsv()
+	c.cmd(150, "STOR b.txt")
+	conn.Write([]byte("0123456789"))
+	deadline := time.Now().Add(time.Second)
+	for {
+		got := c.cmd(211, "STAT")
+		if strings.Contains(got, "Transfer in progress: STOR b.txt, 10 bytes") {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("STAT during transfer got %q", got)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	conn.Close()
+	c.expect(226)
+}
+
+func TestStoreUnique(t *testing.T) {
+	node := &mount.NodeMemory{}
+	_, addr := startTestServer(t, node)
+
+	c := dialTestClient(t, addr, false)
+	defer c.Close()
+	c.login()
+
+	names := make(map[string]bool)
+	for i := 0; i < 3; i++ {
+		conn := c.epsv()
+		msg := c.cmd(150, "STOU drop.csv")
+		if !strings.HasPrefix(msg, "FILE: ") {
+			t.Fatalf("STOU reply %q", msg)
+		}
+		conn.Write([]byte(msg))
+		conn.Close()
+		c.expect(226)
+		names[msg[len("FILE: "):]] = true
+	}
+	if len(names) != 3 || !names["drop.csv"] || !names["drop.csv.1"] || !names["drop.csv.2"] {
+		t.Errorf("STOU names %v", names)
+	}
+	if got := string(c.retrieve("drop.csv.1")); got != "FILE: drop.csv.1" {
+		t.Errorf("RETR got %q", got)
+	}
+
+	// Failing before any data arrives leaves no file behind, whether the
+	// data connection cannot be opened or the data is bad
+	c.cmd(425, "STOU drop.csv")
+	c.cmd(200, "MODE Z")
+	conn := c.epsv()
+	c.cmd(150, "STOU drop.csv")
+	conn.Write([]byte("not zlib"))
+	conn.Close()
+	c.expect(426)
+	if files, _ := node.List("/"); len(files) != 3 {
+		t.Errorf("files left after failed STOU: %v", files)
+	}
+}
+
+func TestRename(t *testing.T) {
+	_, addr := startTestServer(t, &mount.NodeMemory{})
+
+	c := dialTestClient(t, addr, false)
+	defer c.Close()
+	c.login()
+
+	c.store("old.txt", []byte("content"))
+
+	c.cmd(503, "RNTO new.txt")
+	c.cmd(550, "RNFR missing.txt")
+	c.cmd(350, "RNFR old.txt")
+	c.cmd(250, "RNTO new.txt")
+	if got := string(c.retrieve("new.txt")); got != "content" {
+		t.Errorf("RETR renamed file got %q", got)
+	}
+	c.cmd(550, "RETR old.txt")
+
+	// RNTO must immediately follow RNFR
+	c.cmd(350, "RNFR new.txt")
+	c.cmd(200, "NOOP")
+	c.cmd(503, "RNTO newer.txt")
+}
+
+func TestASCIIMode(t *testing.T) {
+	node := &mount.NodeMemory{}
+	_, addr := startTestServer(t, node)
+
+	c := dialTestClient(t, addr, false)
+	defer c.Close()
+	c.login()
+
+	c.cmd(200, "TYPE A")
+	c.store("mixed.txt", []byte("unix\ndos\r\nstray\rcr\r\n"))
+	if got, _ := fileContent(node, "/mixed.txt"); got != "unix\ndos\nstray\rcr\n" {
+		t.Errorf("stored file %q", got)
+	}
+	if got := c.cmd(213, "SIZE mixed.txt"); got != "21" {
+		t.Errorf("SIZE in ASCII mode got %s", got)
+	}
+	putFile(t, node, "large.txt", strings.Repeat("line\n", maxASCIISize/5+1))
+	c.cmd(550, "SIZE large.txt")
+	if got := string(c.retrieve("mixed.txt")); got != "unix\r\ndos\r\nstray\rcr\r\n" {
+		t.Errorf("RETR in ASCII mode got %q", got)
+	}
+
+	c.cmd(200, "TYPE I")
+	if got := c.cmd(213, "SIZE mixed.txt"); got != "18" {
+		t.Errorf("SIZE in Image mode got %s", got)
+	}
+	c.cmd(213, "SIZE large.txt")
+	if got := string(c.retrieve("mixed.txt")); got != "unix\ndos\nstray\rcr\n" {
+		t.Errorf("RETR in Image mode got %q", got)
+	}
+}
+
+func TestModeZ(t *testing.T) {
+	node := &mount.NodeMemory{}
+	_, addr := startTestServer(t, node)
+
+	c := dialTestClient(t, addr, false)
+	defer c.Close()
+	c.login()
+
+	data := bytes.Repeat([]byte("compress me please "), 1000)
+	var zdata bytes.Buffer
+	zw := zlib.NewWriter(&zdata)
+	zw.Write(data)
+	zw.Close()
+
+	c.cmd(200, "MODE Z")
+	c.cmd(501, "OPTS MODE Z LEVEL 10")
+	c.cmd(200, "OPTS MODE Z LEVEL 9")
+	c.store("z.txt", zdata.Bytes())
+	if got, _ := fileContent(node, "/z.txt"); got != string(data) {
+		t.Errorf("stored %d bytes, want %d", len(got), len(data))
+	}
+
+	got := c.retrieve("z.txt")
+	if len(got) >= len(data) {
+		t.Errorf("RETR in MODE Z got %d bytes, not compressed", len(got))
+	}
+	zr, err := zlib.NewReader(bytes.NewReader(got))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := ioutil.ReadAll(zr); !bytes.Equal(got, data) {
+		t.Errorf("RETR in MODE Z got %d bytes uncompressed, want %d", len(got), len(data))
+	}
+
+	c.cmd(200, "MODE S")
+	if got := c.retrieve("z.txt"); !bytes.Equal(got, data) {
+		t.Errorf("RETR in MODE S got %d bytes, want %d", len(got), len(data))
+	}
+}
+
+func TestModeBlock(t *testing.T) {
+	node := &mount.NodeMemory{}
+	_, addr := startTestServer(t, node)
+
+	c := dialTestClient(t, addr, false)
+	defer c.Close()
+	c.login()
+	c.cmd(200, "MODE B")
+
+	// EOF without closing the connection
+	conn := c.epsv()
+	c.cmd(150, "STOR b.txt")
+	conn.Write([]byte{BlockEOF, 0, 5})
+	conn.Write([]byte("hello"))
+	c.expect(226)
+	conn.Close()
+	if got, _ := fileContent(node, "/b.txt"); got != "hello" {
+		t.Errorf("stored %q", got)
+	}
+
+	// Closing before the EOF block fails the transfer, after a marker
+	conn = c.epsv()
+	c.cmd(150, "STOR cut.txt")
+	conn.Write([]byte{0, 0, 6})
+	conn.Write([]byte("hello "))
+	conn.Write([]byte{BlockRestart, 0, 2})
+	conn.Write([]byte("m1"))
+	if msg := c.expect(110); msg != "MARK m1 = 6" {
+		t.Errorf("got restart marker reply %q", msg)
+	}
+	conn.Close()
+	c.expect(426)
+
+	// Restart from the marker
+	c.cmd(350, "REST 6")
+	conn = c.epsv()
+	c.cmd(150, "STOR cut.txt")
+	conn.Write([]byte{BlockEOF, 0, 5})
+	conn.Write([]byte("world"))
+	c.expect(226)
+	conn.Close()
+	if got, _ := fileContent(node, "/cut.txt"); got != "hello world" {
+		t.Errorf("stored %q after restart", got)
+	}
+
+	got := c.retrieve("cut.txt")
+	data, err := ioutil.ReadAll(newBlockReader(bytes.NewReader(got), nil))
+	if err != nil || string(data) != "hello world" {
+		t.Errorf("RETR in MODE B got %q (%v)", data, err)
+	}
+
+	c.cmd(200, "MODE S")
+	if got := c.retrieve("cut.txt"); string(got) != "hello world" {
+		t.Errorf("RETR in MODE S got %q", got)
+	}
+}
+
+func TestHash(t *testing.T) {
+	node := &mount.NodeMemory{}
+	putFile(t, node, "/h.txt", "hello world")
+	_, addr := startTestServer(t, node)
+
+	c := dialTestClient(t, addr, false)
+	defer c.Close()
+	c.login()
+
+	if msg := c.cmd(213, "HASH h.txt"); msg != "SHA-1 0-10 2aae6c35c94fcfb415dbe95f408b9ce91ee846ed h.txt" {
+		t.Errorf("HASH got %q", msg)
+	}
+	c.cmd(550, "HASH nope.txt")
+	c.cmd(501, "OPTS HASH SHA-3")
+	if msg := c.cmd(200, "OPTS HASH MD5"); msg != "MD5" {
+		t.Errorf("OPTS HASH MD5 got %q", msg)
+	}
+	if msg := c.cmd(211, "FEAT"); !strings.Contains(msg, "HASH SHA-1;SHA-256;SHA-512;MD5*;CRC32") || strings.Contains(msg, "RANG") {
+		t.Errorf("FEAT got %q", msg)
+	}
+
+	c.cmd(350, "RANG 0 4")
+	if msg := c.cmd(213, "HASH h.txt"); msg != "MD5 0-4 5d41402abc4b2a76b9719d911017c592 h.txt" {
+		t.Errorf("HASH with RANG got %q", msg)
+	}
+	// The range only applies once
+	if msg := c.cmd(213, "HASH h.txt"); msg != "MD5 0-10 5eb63bbbe01eeed093cb22bb8f5acdc3 h.txt" {
+		t.Errorf("HASH after RANG got %q", msg)
+	}
+	// Nor is it applied to, or kept after, a transfer
+	c.cmd(350, "RANG 0 4")
+	if got := c.retrieve("h.txt"); string(got) != "hello world" {
+		t.Errorf("RETR after RANG got %q", got)
+	}
+	if msg := c.cmd(213, "HASH h.txt"); msg != "MD5 0-10 5eb63bbbe01eeed093cb22bb8f5acdc3 h.txt" {
+		t.Errorf("HASH after RANG and RETR got %q", msg)
+	}
+	c.cmd(350, "RANG 20 30")
+	c.cmd(554, "HASH h.txt")
+	c.cmd(501, "RANG 5 4")
+
+	if msg := c.cmd(250, "XCRC h.txt"); msg != "0d4a1185" {
+		t.Errorf("XCRC got %q", msg)
+	}
+	if msg := c.cmd(250, "XSHA256 h.txt"); msg != "b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9" {
+		t.Errorf("XSHA256 got %q", msg)
+	}
+}
+
+func TestModifyTime(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ftpd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(dir+"/m.txt", []byte("mtime"), 0666)
+	_, addr := startTestServer(t, &mount.NodeSysFolder{Path: dir})
+
+	c := dialTestClient(t, addr, false)
+	defer c.Close()
+	c.login()
+
+	if msg := c.cmd(213, "MFMT 20020717210715 m.txt"); msg != "Modify=20020717210715; m.txt" {
+		t.Errorf("MFMT got %q", msg)
+	}
+	if msg := c.cmd(213, "MDTM m.txt"); msg != "20020717210715" {
+		t.Errorf("MDTM after MFMT got %q", msg)
+	}
+	c.cmd(501, "MFMT 2002 m.txt")
+	c.cmd(550, "MFMT 20020717210715 nope.txt")
+
+	if msg := c.cmd(213, "MFF modify=20101231235959.5; m.txt"); msg != "modify=20101231235959; m.txt" {
+		t.Errorf("MFF got %q", msg)
+	}
+	if msg := c.cmd(213, "MDTM m.txt"); msg != "20101231235959" {
+		t.Errorf("MDTM after MFF got %q", msg)
+	}
+	c.cmd(504, "MFF create=20101231235959; m.txt")
+	c.cmd(501, "MFF modify; m.txt")
+
+	// Not supported by the node
+	_, addr = startTestServer(t, struct{ mount.Node }{&mount.NodeMemory{}})
+	c = dialTestClient(t, addr, false)
+	defer c.Close()
+	c.login()
+	c.cmd(502, "MFMT 20020717210715 m.txt")
+}
+
+func TestMLSX(t *testing.T) {
+	node := &mount.NodeMemory{}
+	node.MakeDirectory("/sub")
+	putFile(t, node, "/sub/a.txt", "hello")
+	modify := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	for _, file := range []string{"/", "/sub", "/sub/a.txt"} {
+		node.SetModTime(file, modify)
+	}
+	_, addr := startTestServer(t, node)
+
+	c := dialTestClient(t, addr, false)
+	defer c.Close()
+	c.login()
+
+	want := "type=cdir;size=0;modify=20200102030405;perm=cdeflmp; .\r\n" +
+		"type=pdir;size=0;modify=20200102030405;perm=cdeflmp; ..\r\n" +
+		"type=file;size=5;modify=20200102030405;perm=adfrw; a.txt\r\n"
+	if got := c.list("MLSD sub"); got != want {
+		t.Errorf("MLSD got %q, want %q", got, want)
+	}
+	if msg := c.cmd(250, "MLST sub/a.txt"); !strings.Contains(msg, "type=file;size=5;modify=20200102030405;perm=adfrw; /sub/a.txt") {
+		t.Errorf("MLST got %q", msg)
+	}
+
+	if msg := c.cmd(200, "OPTS MLST type;perm;bogus;Media-Type;"); msg != "MLST OPTS type;perm;media-type;" {
+		t.Errorf("OPTS MLST got %q", msg)
+	}
+	if msg := c.cmd(211, "FEAT"); !strings.Contains(msg, "MLST type*;size;modify;create;perm*;unique;UNIX.mode;UNIX.owner;UNIX.group;media-type*;") {
+		t.Errorf("FEAT got %q", msg)
+	}
+	want = "type=cdir;perm=cdeflmp; .\r\n" +
+		"type=pdir;perm=cdeflmp; ..\r\n" +
+		"type=file;perm=adfrw;media-type=text/plain; a.txt\r\n"
+	if got := c.list("MLSD sub"); got != want {
+		t.Errorf("MLSD got %q, want %q", got, want)
+	}
+
+	c.cmd(200, "OPTS MLST create;")
+	if msg := c.cmd(250, "MLST sub/a.txt"); !strings.HasPrefix(strings.TrimSpace(strings.Split(msg, "\n")[1]), "create=20") {
+		t.Errorf("MLST with create got %q", msg)
+	}
+
+	if msg := c.cmd(200, "OPTS MLST"); msg != "MLST OPTS" {
+		t.Errorf("OPTS MLST got %q", msg)
+	}
+	if got := c.list("MLSD /"); got != " .\r\n sub\r\n" {
+		t.Errorf("MLSD got %q", got)
+	}
+}
+
+func TestList(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ftpd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	os.Mkdir(dir+"/sub", 0755)
+	ioutil.WriteFile(dir+"/sub/.hidden", nil, 0600)
+	ioutil.WriteFile(dir+"/sub/b.txt", nil, 0644)
+	ioutil.WriteFile(dir+"/sub/a.txt", nil, 0640)
+	os.Chtimes(dir+"/sub/a.txt", time.Unix(1e9, 0), time.Unix(1e9, 0))
+	for name, mode := range map[string]os.FileMode{"sub": 0755, "sub/.hidden": 0600, "sub/b.txt": 0644, "sub/a.txt": 0640} {
+		os.Chmod(dir+"/"+name, mode) // Regardless of umask
+	}
+	_, addr := startTestServer(t, &mount.NodeSysFolder{Path: dir})
+
+	c := dialTestClient(t, addr, false)
+	defer c.Close()
+	c.login()
+
+	list := func(param string) []string {
+		data := c.list("LIST " + param)
+
+		// Keep the mode and the name of each line
+		var lines []string
+		for _, line := range strings.Split(strings.TrimSuffix(data, "\r\n"), "\r\n") {
+			if fields := strings.Fields(line); len(fields) > 2 {
+				line = fields[0] + " " + fields[len(fields)-1]
+			}
+			lines = append(lines, line)
+		}
+		return lines
+	}
+	check := func(param string, want ...string) {
+		t.Helper()
+		if got := list(param); strings.Join(got, "|") != strings.Join(want, "|") {
+			t.Errorf("LIST %s got %q, want %q", param, got, want)
+		}
+	}
+
+	check("sub", "-rw-r----- a.txt", "-rw-r--r-- b.txt")
+	check("-la /sub", "-rw------- .hidden", "-rw-r----- a.txt", "-rw-r--r-- b.txt")
+	check("-t sub", "-rw-r--r-- b.txt", "-rw-r----- a.txt")
+	check("-t -l sub/a.txt", "-rw-r----- sub/a.txt")
+	check("-R", ".:", "drwxr-xr-x sub", "", "sub:", "-rw-r----- a.txt", "-rw-r--r-- b.txt")
+	c.cmd(550, "LIST nope")
+}
+
+func TestHidden(t *testing.T) {
+	node := &mount.NodeMemory{}
+	putFile(t, node, "/a.txt", "a")
+	putFile(t, node, "/Thumbs.db", "thumbs")
+	node.MakeDirectory("/.git")
+	putFile(t, node, "/.git/HEAD", "ref")
+	filter, err := mount.Hide(node, ".*", "Thumbs.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, addr := startTestServer(t, filter)
+
+	c := dialTestClient(t, addr, false)
+	defer c.Close()
+	c.login()
+
+	for _, cmd := range []string{"LIST -a", "NLST", "MLSD"} {
+		if got := c.list(cmd); strings.Contains(got, "Thumbs") || strings.Contains(got, ".git") || !strings.Contains(got, "a.txt") {
+			t.Errorf("%s got %q", cmd, got)
+		}
+	}
+	c.cmd(550, "SIZE Thumbs.db")
+	c.cmd(550, "RETR .git/HEAD")
+	c.cmd(550, "STOR .hidden")
+	c.cmd(213, "SIZE a.txt")
+}
+
+func TestAccessMounts(t *testing.T) {
+	pub, in := &mount.NodeMemory{}, &mount.NodeMemory{}
+	putFile(t, pub, "/a.txt", "a")
+	tree := mount.NewNodeTree()
+	tree.Mount("/pub", mount.ReadOnly(pub))
+	tree.Mount("/incoming", mount.WriteOnly(in))
+	_, addr := startTestServer(t, tree)
+
+	c := dialTestClient(t, addr, false)
+	defer c.Close()
+	c.login()
+
+	if got := c.retrieve("/pub/a.txt"); string(got) != "a" {
+		t.Errorf("RETR on a read-only mount got %q", got)
+	}
+	c.cmd(550, "STOR /pub/b.txt")
+	c.cmd(550, "DELE /pub/a.txt")
+	if msg := c.cmd(250, "MLST /pub/a.txt"); !strings.Contains(msg, "perm=r;") {
+		t.Errorf("MLST on a read-only mount got %q", msg)
+	}
+	if got := c.list("LIST /pub"); !strings.HasPrefix(got, "-r--r--r-- ") {
+		t.Errorf("LIST on a read-only mount got %q", got)
+	}
+	if msg := c.cmd(250, "MLST /incoming"); !strings.Contains(msg, "perm=cem;") {
+		t.Errorf("MLST on a write-only mount got %q", msg)
+	}
+
+	c.cmd(200, "CWD /incoming")
+	c.store("upload.txt", []byte("upload"))
+	if got, _ := fileContent(in, "/upload.txt"); got != "upload" {
+		t.Errorf("stored %q on a write-only mount", got)
+	}
+	c.cmd(550, "RETR upload.txt")
+	c.cmd(550, "SIZE upload.txt")
+	c.cmd(550, "LIST")
+	c.cmd(550, "STOR upload.txt")
+}
+
+// homeAuth logs in any user with the password "pass" at their home folder.
+type homeAuth map[string]string
+
+func (a homeAuth) Login(username, password string) auth.AccessType {
+	if password != "pass" {
+		return auth.NoPermission
+	}
+	return auth.ReadWrite
+}
+
+func (a homeAuth) Root(username string) (mount.Node, string) { return nil, a[username] }
+
+func TestUserRoots(t *testing.T) {
+	node := &mount.NodeMemory{}
+	node.MakeDirectory("/home/alice")
+	node.MakeDirectory("/home/bob")
+	putFile(t, node, "/home/alice/f.txt", "alice")
+	putFile(t, node, "/home/bob/f.txt", "bobby")
+	_, addr := startTestServer(t, node, func(s *Server) {
+		s.Auth = homeAuth{"alice": "/home/alice", "bob": "/home/bob/", "carol": "/home/carol"}
+		s.HashCacheSize = 10
+	})
+
+	login := func(user string) *testClient {
+		c := dialTestClient(t, addr, false)
+		c.cmd(331, "USER %s", user)
+		c.cmd(230, "PASS pass")
+		return c
+	}
+
+	alice := login("alice")
+	defer alice.Close()
+	bob := login("bob")
+	defer bob.Close()
+
+	alice.cmd(550, "CDUP")
+	alice.cmd(257, "PWD")
+	if got := alice.retrieve("../../f.txt"); string(got) != "alice" {
+		t.Errorf("alice got %q", got)
+	}
+	alice.cmd(550, "SIZE /home/bob/f.txt")
+	if got := bob.retrieve("/f.txt"); string(got) != "bobby" {
+		t.Errorf("bob got %q", got)
+	}
+	bob.store("new.txt", []byte("new"))
+	if got, _ := fileContent(node, "/home/bob/new.txt"); got != "new" {
+		t.Errorf("bob stored %q", got)
+	}
+
+	// Same path and size, but not the same file
+	sum := alice.cmd(213, "HASH f.txt")
+	if other := bob.cmd(213, "HASH f.txt"); other == sum {
+		t.Errorf("alice and bob got the same HASH %q", sum)
+	}
+
+	// Missing home folder
+	c := dialTestClient(t, addr, false)
+	defer c.Close()
+	c.cmd(331, "USER carol")
+	c.cmd(530, "PASS pass")
+}
+
+func TestMissingArgument(t *testing.T) {
+	_, addr := startTestServer(t, &mount.NodeMemory{})
+
+	c := dialTestClient(t, addr, false)
+	defer c.Close()
+	c.cmd(501, "USER")
+	c.login()
+
+	for _, cmd := range []string{
+		"CWD", "PORT", "EPRT", "TYPE", "STRU", "MODE", "REST", "RETR", "STOR", "APPE",
+		"RNFR", "DELE", "RMD", "MKD", "SIZE", "MDTM", "MFMT", "MFF", "HASH", "RANG",
+		"XCRC", "XSHA256", "CWD ",
+	} {
+		c.cmd(501, "%s", cmd)
+	}
+	c.cmd(200, "NOOP")
+}
+
+func TestPaths(t *testing.T) {
+	node := &mount.NodeMemory{}
+	node.MakeDirectory("/sub")
+	_, addr := startTestServer(t, node)
+
+	c := dialTestClient(t, addr, false)
+	defer c.Close()
+	c.login()
+
+	c.cmd(200, "CWD sub/")
+	c.store("/abs.txt", []byte("abs"))
+	if _, ok := fileContent(node, "/abs.txt"); !ok {
+		t.Error("STOR /abs.txt not stored at /abs.txt")
+	}
+	c.store("./x/../rel.txt", []byte("rel"))
+	if _, ok := fileContent(node, "/sub/rel.txt"); !ok {
+		t.Error("STOR ./x/../rel.txt not stored at /sub/rel.txt")
+	}
+	if got := c.retrieve("../../../abs.txt"); string(got) != "abs" {
+		t.Errorf("RETR ../../../abs.txt got %q", got)
+	}
+	c.cmd(213, "SIZE //sub//rel.txt")
+
+	c.cmd(200, "CWD ../../..")
+	if msg := c.cmd(257, "PWD"); !strings.HasPrefix(msg, `"/"`) {
+		t.Errorf("PWD after CWD ../../.. got %q", msg)
+	}
+}
+
+func TestTreePaths(t *testing.T) {
+	tree := mount.NewNodeTree()
+	tree.Mount("/mem", &mount.NodeMemory{})
+	_, addr := startTestServer(t, tree)
+
+	c := dialTestClient(t, addr, false)
+	defer c.Close()
+	c.login()
+
+	// Missing folders outside of any mount
+	for _, cmd := range []string{"MLSD /nope", "LIST /nope", "NLST /nope", "MLST /nope", "STAT /nope"} {
+		c.cmd(550, "%s", cmd)
+	}
+	c.cmd(200, "NOOP")
+}
+
+func TestSymlinkListing(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ftpd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(dir+"/file", nil, 0644)
+	os.Symlink("file", dir+"/link")
+	_, addr := startTestServer(t, &mount.NodeSysFolder{Path: dir, Symlinks: mount.SymlinkShowAsLink})
+
+	c := dialTestClient(t, addr, false)
+	defer c.Close()
+	c.login()
+
+	if got := c.list("LIST"); !strings.Contains(got, " link -> file\r\n") || !strings.Contains(got, "\r\nlrwxrwxrwx") {
+		t.Errorf("LIST got %q", got)
+	}
+	if got := c.list("MLSD"); !strings.Contains(got, "type=OS.unix=symlink;") {
+		t.Errorf("MLSD got %q", got)
+	}
+	if got := c.retrieve("link"); len(got) != 0 {
+		t.Errorf("RETR link got %q", got)
+	}
+}
+
+// listRecorder is a Node recording the folders listed.
+type listRecorder struct {
+	mount.Node
+	lock    sync.Mutex
+	folders []string
+}
+
+func (n *listRecorder) List(folder string) ([]mount.File, error) {
+	n.lock.Lock()
+	n.folders = append(n.folders, folder)
+	n.lock.Unlock()
+	return n.Node.List(folder)
+}
+
+func TestRecursiveListPaths(t *testing.T) {
+	mem := &mount.NodeMemory{}
+	mem.MakeDirectory("/a/b")
+	node := &listRecorder{Node: mem}
+	_, addr := startTestServer(t, node)
+
+	c := dialTestClient(t, addr, false)
+	defer c.Close()
+	c.login()
+
+	for _, dir := range []string{"/", "//", "/a/..", "."} {
+		c.list("LIST -R " + dir)
+	}
+	node.lock.Lock()
+	defer node.lock.Unlock()
+	for _, folder := range node.folders {
+		if folder != "/" && folder != "/a" && folder != "/a/b" {
+			t.Errorf("listed folder %q", folder)
+		}
+	}
+}
+
+func TestRecursiveListLoop(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ftpd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	os.Mkdir(dir+"/sub", 0755)
+	ioutil.WriteFile(dir+"/sub/file", nil, 0644)
+	os.Symlink(".", dir+"/a")
+	os.Symlink(".", dir+"/b")
+	os.Symlink("..", dir+"/sub/up")
+	_, addr := startTestServer(t, &mount.NodeSysFolder{Path: dir})
+
+	c := dialTestClient(t, addr, false)
+	defer c.Close()
+	c.login()
+
+	// Each folder is listed once, however many links lead to it
+	got := c.list("LIST -R")
+	if strings.Count(got, ":\r\n") != 2 || !strings.HasPrefix(got, ".:\r\n") || !strings.Contains(got, "\r\nsub:\r\n") {
+		t.Errorf("LIST -R got %q", got)
+	}
+}
+
+// testTLSConfigs returns the config of a server with a new self-signed
+// certificate for 127.0.0.1, and the config of a client trusting it.
+func testTLSConfigs(t testing.TB) (server, client *tls.Config) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "ftpd test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+
+	server = &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+	client = &tls.Config{RootCAs: pool, ServerName: "127.0.0.1"}
+	return
+}
+
+func TestExplicitTLS(t *testing.T) {
+	node := &mount.NodeMemory{}
+	putFile(t, node, "secret.txt", "protected content")
+	serverTLS, clientTLS := testTLSConfigs(t)
+	_, addr := startTestServer(t, node, func(s *Server) {
+		s.TLSConfig = serverTLS
+		s.TLSRequired = true
+	})
+
+	c := dialTestClient(t, addr, false)
+	defer c.Close()
+	if feat := c.cmd(211, "FEAT"); !strings.Contains(feat, "AUTH TLS") || !strings.Contains(feat, "PROT") {
+		t.Errorf("FEAT got %q", feat)
+	}
+	c.cmd(534, "USER user")
+	c.cmd(534, "PASS pass")
+	c.cmd(503, "PBSZ 0")
+	c.cmd(503, "PROT P")
+	c.cmd(504, "AUTH GSSAPI")
+
+	c.cmd(234, "AUTH TLS")
+	c.startTLS(clientTLS)
+	c.cmd(503, "AUTH TLS")
+	c.login()
+
+	c.cmd(503, "PROT P")
+	c.cmd(501, "PBSZ x")
+	c.cmd(200, "PBSZ 0")
+	c.cmd(536, "PROT S")
+	c.cmd(504, "PROT X")
+	c.cmd(200, "PROT P")
+	c.dataTLS = clientTLS
+	if got := c.retrieve("secret.txt"); string(got) != "protected content" {
+		t.Errorf("protected RETR got %q", got)
+	}
+	c.store("upload.txt", []byte("uploaded"))
+	if got, _ := fileContent(node, "upload.txt"); got != "uploaded" {
+		t.Errorf("protected STOR got %q", got)
+	}
+
+	// A clear data connection is refused while protected
+	c.dataTLS = nil
+	conn := c.epsv()
+	c.cmd(150, "RETR secret.txt")
+	conn.Write([]byte("clear\r\n"))
+	conn.Close()
+	c.expect(425)
+
+	c.cmd(200, "PROT C")
+	if got := c.retrieve("secret.txt"); string(got) != "protected content" {
+		t.Errorf("clear RETR got %q", got)
+	}
+}
+
+func TestImplicitTLS(t *testing.T) {
+	node := &mount.NodeMemory{}
+	putFile(t, node, "secret.txt", "protected content")
+	serverTLS, clientTLS := testTLSConfigs(t)
+	port := freePort(t)
+	_, addr := startTestServer(t, node, func(s *Server) {
+		s.TLSConfig = serverTLS
+		s.ImplicitTLSPort = port
+	})
+
+	conn, err := tls.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)), clientTLS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &testClient{Conn: textproto.NewConn(conn), conn: conn, t: t, dataTLS: clientTLS}
+	defer c.Close()
+	c.expect(220)
+	c.cmd(503, "AUTH TLS")
+	c.login()
+
+	// Data connections are protected without PBSZ and PROT, and cannot be clear
+	if got := c.retrieve("secret.txt"); string(got) != "protected content" {
+		t.Errorf("RETR got %q", got)
+	}
+	c.cmd(534, "PROT C")
+	c.cmd(200, "PBSZ 0")
+	c.cmd(200, "PROT P")
+	c.store("upload.txt", []byte("uploaded"))
+	if got, _ := fileContent(node, "upload.txt"); got != "uploaded" {
+		t.Errorf("STOR got %q", got)
+	}
+
+	// The explicit port is still served in the clear
+	clear := dialTestClient(t, addr, false)
+	defer clear.Close()
+	clear.login()
+	if got := clear.retrieve("secret.txt"); string(got) != "protected content" {
+		t.Errorf("clear RETR got %q", got)
+	}
+}
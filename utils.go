@@ -2,12 +2,19 @@ package ftpd
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
+	"mime"
 	"net"
+	"path"
 	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
 
+	"github.com/Edgaru089/ftpd/auth"
+
 	"github.com/Edgaru089/ftpd/mount"
 )
 
@@ -55,30 +62,86 @@ func writeFTPReplySingleline(writer io.WriteCloser, buf *bytes.Buffer, code int,
 	}
 }
 
+var (
+	errBadHostPort     = errors.New("malformed host-port")
+	errUnknownNetProto = errors.New("unknown network protocol")
+)
+
 // Parses FTP Host-Port representation (h1,h2,h3,h4,p1,p2)
-func parseHostPort(param []byte) (ip net.IP, port int) {
-	var h1, h2, h3, h4, p1, p2 int
-	fmt.Fscanf(bytes.NewReader(param), "%d,%d,%d,%d,%d,%d", &h1, &h2, &h3, &h4, &p1, &p2)
-	port = p1<<8 + p2
-	ip = net.IP{byte(h1), byte(h2), byte(h3), byte(h4)}
+func parseHostPort(param []byte) (ip net.IP, port int, err error) {
+	var h [6]int
+	_, err = fmt.Sscanf(string(param), "%d,%d,%d,%d,%d,%d", &h[0], &h[1], &h[2], &h[3], &h[4], &h[5])
+	if err != nil {
+		return nil, 0, errBadHostPort
+	}
+	for _, b := range h {
+		if b < 0 || b > 255 {
+			return nil, 0, errBadHostPort
+		}
+	}
+	port = h[4]<<8 + h[5]
+	ip = net.IPv4(byte(h[0]), byte(h[1]), byte(h[2]), byte(h[3]))
 	return
 }
 
-// Packs FTP Host-Port representation. Panics if ip is not a IPv4 address.
-func packHostPort(writer io.Writer, ip net.IP, port int) {
+// Parses RFC 2428 Extended Host-Port representation (|af|addr|port|),
+// where the delimiter is the first character and af is 1 (IPv4) or 2 (IPv6).
+func parseExtHostPort(param []byte) (ip net.IP, port int, err error) {
+	if len(param) == 0 {
+		return nil, 0, errBadHostPort
+	}
+	fields := strings.Split(string(param), string(param[0]))
+	if len(fields) != 5 || len(fields[0]) != 0 || len(fields[4]) != 0 {
+		return nil, 0, errBadHostPort
+	}
+
+	ip = net.ParseIP(fields[2])
+	switch fields[1] {
+	case "1":
+		if ip == nil || ip.To4() == nil {
+			return nil, 0, errBadHostPort
+		}
+	case "2":
+		if ip == nil || ip.To4() != nil {
+			return nil, 0, errBadHostPort
+		}
+	default:
+		return nil, 0, errUnknownNetProto
+	}
+
+	port, err = strconv.Atoi(fields[3])
+	if err != nil || port <= 0 || port > 65535 {
+		return nil, 0, errBadHostPort
+	}
+	return ip, port, nil
+}
+
+var errNotIPv4 = errors.New("IP not IPv4")
+
+// Packs FTP Host-Port representation. Returns errNotIPv4 if ip is not a IPv4 address.
+func packHostPort(writer io.Writer, ip net.IP, port int) error {
 	ip4 := ip.To4()
 	if ip4 == nil {
-		panic("packHostPort: IP not IPv4")
+		return errNotIPv4
 	}
 
-	fmt.Fprintf(writer, "%d,%d,%d,%d,%d,%d", ip4[0], ip4[1], ip4[2], ip4[3], (port&0xff00)>>8, port&0xff)
+	_, err := fmt.Fprintf(writer, "%d,%d,%d,%d,%d,%d", ip4[0], ip4[1], ip4[2], ip4[3], (port&0xff00)>>8, port&0xff)
+	return err
 }
 
 // Calls packHostPort with a Buffer.
-func packHostPortSlice(ip net.IP, port int) []byte {
+func packHostPortSlice(ip net.IP, port int) ([]byte, error) {
 	var buf bytes.Buffer
-	packHostPort(&buf, ip, port)
-	return buf.Bytes()
+	err := packHostPort(&buf, ip, port)
+	return buf.Bytes(), err
+}
+
+// Returns the RFC 2428 network protocol number list for a "tcp4" or "tcp6" network.
+func networkProtoString(network string) string {
+	if network == "tcp6" {
+		return "2"
+	}
+	return "1"
 }
 
 func wrapSlash(src string) string {
@@ -94,6 +157,25 @@ func wrapSlash(src string) string {
 	return src
 }
 
+// commandArg returns the argument after the command cmd and a Space in
+// the command line, or empty if there is none.
+func commandArg(line, cmd []byte) string {
+	if len(line) <= len(cmd)+1 {
+		return ""
+	}
+	return string(line[len(cmd)+1:])
+}
+
+// resolvePath resolves a path argument against the working directory wd
+// into a clean absolute virtual path. "." and ".." elements, repeated and
+// trailing slashes are resolved, and ".." never goes above "/".
+func resolvePath(wd, param string) string {
+	if len(param) == 0 || param[0] != '/' {
+		param = wd + "/" + param
+	}
+	return path.Clean(param)
+}
+
 func ftpTime(t time.Time) string {
 	utc := t.UTC()
 	y, m, d := utc.Date()
@@ -102,6 +184,14 @@ func ftpTime(t time.Time) string {
 	// TODO Sub-second time
 }
 
+// parseFTPTime parses a YYYYMMDDHHMMSS[.sss] time value in UTC (RFC 3659).
+func parseFTPTime(str string) (time.Time, error) {
+	if len(str) < 14 {
+		return time.Time{}, errors.New("parseFTPTime: time value too short")
+	}
+	return time.Parse("20060102150405", str)
+}
+
 func fileTypeString(isDir bool) string {
 	if isDir {
 		return "dir"
@@ -110,6 +200,219 @@ func fileTypeString(isDir bool) string {
 	}
 }
 
-func formatMLSXString(writer io.Writer, file *mount.File) (n int, err error) {
-	return fmt.Fprintf(writer, "type=%s;size=%d;modify=%s; %s", fileTypeString(file.IsDirectory), file.Size, ftpTime(file.LastModify), file.Name)
+// MLST facts, in the order listed (RFC 3659 7.5)
+var mlstFacts = []string{"type", "size", "modify", "create", "perm", "unique", "UNIX.mode", "UNIX.owner", "UNIX.group", "media-type"}
+
+// MLST fact bits, in the order of mlstFacts
+const (
+	mlstType = 1 << iota
+	mlstSize
+	mlstModify
+	mlstCreate
+	mlstPerm
+	mlstUnique
+	mlstUnixMode
+	mlstUnixOwner
+	mlstUnixGroup
+	mlstMediaType
+)
+
+// Facts enabled before any OPTS MLST.
+const defaultMLSTFacts = mlstType | mlstSize | mlstModify | mlstPerm | mlstUnique | mlstUnixMode
+
+// mlstFeature returns the MLST line in FEAT, with the enabled facts marked by a '*'.
+func mlstFeature(enabled uint) string {
+	var b strings.Builder
+	b.WriteString(" MLST ")
+	for i, fact := range mlstFacts {
+		b.WriteString(fact)
+		if enabled&(1<<uint(i)) != 0 {
+			b.WriteByte('*')
+		}
+		b.WriteByte(';')
+	}
+	b.WriteString("\r\n")
+	return b.String()
+}
+
+// parseMLSTFacts parses the fact list of OPTS MLST, ignoring unknown facts.
+func parseMLSTFacts(list string) (enabled uint) {
+	for _, name := range strings.Split(list, ";") {
+		for i, fact := range mlstFacts {
+			if strings.EqualFold(name, fact) {
+				enabled |= 1 << uint(i)
+			}
+		}
+	}
+	return
+}
+
+// mlstFactString returns the enabled facts as in the OPTS MLST reply.
+func mlstFactString(enabled uint) string {
+	var b strings.Builder
+	for i, fact := range mlstFacts {
+		if enabled&(1<<uint(i)) != 0 {
+			b.WriteString(fact)
+			b.WriteByte(';')
+		}
+	}
+	return b.String()
+}
+
+// mlsxPerm returns the perm fact of a file for an access level (RFC 3659 7.5.5),
+// limited by what the Node allows on the file.
+func mlsxPerm(file *mount.File, a auth.AccessType) string {
+	isDir := file.IsDirectory
+	switch file.Access {
+	case mount.AccessReadOnly:
+		if a == auth.ReadWrite {
+			a = auth.ReadOnly
+		}
+	case mount.AccessWriteOnly:
+		// Folders can be entered, and have files and folders created in them
+		switch {
+		case !isDir || a == auth.NoPermission:
+			return ""
+		case a == auth.ReadWrite:
+			return "cem"
+		}
+		return "e"
+	}
+
+	switch {
+	case a == auth.ReadWrite && isDir:
+		return "cdeflmp"
+	case a == auth.ReadWrite:
+		return "adfrw"
+	case a == auth.ReadOnly && isDir:
+		return "el"
+	case a == auth.ReadOnly:
+		return "r"
+	}
+	return ""
+}
+
+// mediaType returns the MIME media type of a file, guessed from the
+// extension if unknown to the Node, without any parameters.
+func mediaType(file *mount.File) string {
+	typ := file.MediaType
+	if len(typ) == 0 {
+		typ = mime.TypeByExtension(path.Ext(file.Name))
+	}
+	if i := strings.IndexByte(typ, ';'); i != -1 {
+		typ = typ[:i]
+	}
+	return strings.TrimSpace(typ)
+}
+
+// formatMLSXString formats the enabled facts of a file and its name as a
+// MLST/MLSD entry, without the line ending. The type fact is typ if not
+// empty ("cdir" or "pdir"), and perm is computed from the access level.
+func formatMLSXString(writer io.Writer, file *mount.File, name, typ string, facts uint, access auth.AccessType) (n int, err error) {
+	var b strings.Builder
+	if facts&mlstType != 0 {
+		if len(typ) == 0 && len(file.LinkTarget) != 0 {
+			typ = "OS.unix=symlink"
+		} else if len(typ) == 0 {
+			typ = fileTypeString(file.IsDirectory)
+		}
+		fmt.Fprintf(&b, "type=%s;", typ)
+	}
+	if facts&mlstSize != 0 {
+		fmt.Fprintf(&b, "size=%d;", file.Size)
+	}
+	if facts&mlstModify != 0 && !file.LastModify.IsZero() {
+		fmt.Fprintf(&b, "modify=%s;", ftpTime(file.LastModify))
+	}
+	if facts&mlstCreate != 0 && !file.Create.IsZero() {
+		fmt.Fprintf(&b, "create=%s;", ftpTime(file.Create))
+	}
+	if facts&mlstPerm != 0 {
+		fmt.Fprintf(&b, "perm=%s;", mlsxPerm(file, access))
+	}
+	if facts&mlstUnique != 0 && len(file.Unique) != 0 {
+		fmt.Fprintf(&b, "unique=%s;", file.Unique)
+	}
+	if facts&mlstUnixMode != 0 && file.Mode != 0 {
+		fmt.Fprintf(&b, "UNIX.mode=0%o;", file.Mode.Perm())
+	}
+	if facts&mlstUnixOwner != 0 && len(file.Owner) != 0 {
+		fmt.Fprintf(&b, "UNIX.owner=%s;", file.Owner)
+	}
+	if facts&mlstUnixGroup != 0 && len(file.Group) != 0 {
+		fmt.Fprintf(&b, "UNIX.group=%s;", file.Group)
+	}
+	if facts&mlstMediaType != 0 && !file.IsDirectory {
+		if typ := mediaType(file); len(typ) != 0 {
+			fmt.Fprintf(&b, "media-type=%s;", typ)
+		}
+	}
+	b.WriteByte(' ')
+	b.WriteString(name)
+	return io.WriteString(writer, b.String())
+}
+
+// permString returns the permission bits listed in LIST for an access level.
+func permString(a auth.AccessType) string {
+	switch a {
+	case auth.ReadOnly:
+		return "r--r--r--"
+	case auth.ReadWrite:
+		return "rw-rw-rw-"
+	}
+	return "---------"
+}
+
+// formatListString formats a file as a /bin/ls -l line, without the line ending.
+// Refer to https://cr.yp.to/ftp/list/binls.html for details on the format.
+//
+// permstr is listed if the Node does not know the permission bits of the file.
+// Either is masked by what the Node allows on the file.
+func formatListString(writer io.Writer, file *mount.File, permstr string, year int) (n int, err error) {
+	typ, name := '-', file.Name
+	if file.IsDirectory {
+		typ = 'd'
+	}
+	if len(file.LinkTarget) != 0 {
+		typ, name = 'l', file.Name+" -> "+file.LinkTarget
+	}
+	if file.Mode != 0 {
+		permstr = file.Mode.Perm().String()[1:] // Without the type
+	}
+	switch file.Access {
+	case mount.AccessReadOnly:
+		permstr = strings.Replace(permstr, "w", "-", -1)
+	case mount.AccessWriteOnly:
+		permstr = strings.Replace(permstr, "r", "-", -1)
+	}
+	links, owner, group := file.Links, file.Owner, file.Group
+	if links == 0 {
+		links = 1
+	}
+	if len(owner) == 0 {
+		owner = "user"
+	}
+	if len(group) == 0 {
+		group = "group"
+	}
+
+	var t string
+	if file.LastModify.Year() != year {
+		t = file.LastModify.Format("Jan _2 2006")
+	} else {
+		t = file.LastModify.Format("Jan _2 15:04")
+	}
+	return fmt.Fprintf(writer, "%c%s %3d %-8s %-8s %12d %s %s", typ, permstr, links, owner, group, file.Size, t, name)
+}
+
+// countWriter adds the number of bytes written through it to n atomically.
+type countWriter struct {
+	w io.Writer
+	n *int64
+}
+
+func (cw countWriter) Write(p []byte) (n int, err error) {
+	n, err = cw.w.Write(p)
+	atomic.AddInt64(cw.n, int64(n))
+	return
 }
@@ -0,0 +1,43 @@
+package ftpd
+
+import (
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestResolvePath(t *testing.T) {
+	tests := []struct{ wd, param, want string }{
+		{"/", "", "/"},
+		{"/", "a", "/a"},
+		{"/a", "b/", "/a/b"},
+		{"/a", "/b", "/b"},
+		{"/a", "//b//c/", "/b/c"},
+		{"/a/b", "..", "/a"},
+		{"/a/b", "./c/../d", "/a/b/d"},
+		{"/a", "../../../etc", "/etc"},
+		{"/", "..", "/"},
+	}
+	for _, tc := range tests {
+		if got := resolvePath(tc.wd, tc.param); got != tc.want {
+			t.Errorf("resolvePath(%q, %q) = %q, want %q", tc.wd, tc.param, got, tc.want)
+		}
+	}
+}
+
+func FuzzResolvePath(f *testing.F) {
+	f.Add("/", "../..")
+	f.Add("/a/b", "./c//d/")
+	f.Fuzz(func(t *testing.T, wd, param string) {
+		wd = resolvePath("/", wd)
+		got := resolvePath(wd, param)
+		if !strings.HasPrefix(got, "/") || path.Clean(got) != got {
+			t.Fatalf("resolvePath(%q, %q) = %q, not clean and absolute", wd, param, got)
+		}
+		for _, elem := range strings.Split(got, "/") {
+			if elem == ".." || elem == "." {
+				t.Fatalf("resolvePath(%q, %q) = %q", wd, param, got)
+			}
+		}
+	})
+}